@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// supported values for Query.Aggregation
+const (
+	aggregationSum  = "sum"
+	aggregationMax  = "max"
+	aggregationMin  = "min"
+	aggregationLast = "last"
+)
+
+// validAggregation reports whether fn is a supported aggregation function
+func validAggregation(fn string) bool {
+	switch fn {
+	case "", aggregationSum, aggregationMax, aggregationMin, aggregationLast:
+		return true
+	}
+	return false
+}
+
+// aggregation folds the values of all rows sharing the same label values
+// into a single value, so they don't end up as duplicate series. The labels
+// of metric columns hold the value of each row, so they are left out.
+type aggregation struct {
+	fn          string
+	foldedOnly  bool     // only rows with folded labels are added, see Query.newFoldAggregation
+	valueLabels []bool   // labels of metric columns, which are dropped
+	keys        []string // keeps the order in which label sets were first seen
+	labels      map[string][]string
+	values      map[string]float64
+	times       map[string]time.Time // latest sample time of each label set
+}
+
+// newAggregation returns an aggregation of the rows with the given label
+// names, see Query.labelNames
+func newAggregation(fn string, labelNames []string) *aggregation {
+	valueLabels := make([]bool, len(labelNames))
+	for i, name := range labelNames {
+		valueLabels[i] = strings.HasPrefix(name, "metric_")
+	}
+	return &aggregation{
+		fn:          fn,
+		valueLabels: valueLabels,
+		labels:      make(map[string][]string),
+		values:      make(map[string]float64),
+		times:       make(map[string]time.Time),
+	}
+}
+
+// newFoldAggregation returns an aggregation which sums the rows with labels
+// folded by limitCardinality, which would otherwise be dropped as duplicate
+// series. The labels of metric columns are kept, unless the descriptor has
+// none, see setDesc.
+func (q *Query) newFoldAggregation(labelNames []string) *aggregation {
+	a := newAggregation(aggregationSum, labelNames)
+	a.foldedOnly = true
+	if !q.Cumulative {
+		a.valueLabels = make([]bool, len(labelNames))
+	}
+	return a
+}
+
+// add folds value into the value stored for the given label values
+func (a *aggregation) add(labels []string, value float64, ts time.Time) {
+	kept := make([]string, 0, len(labels))
+	for i, lv := range labels {
+		if i >= len(a.valueLabels) || !a.valueLabels[i] {
+			kept = append(kept, lv)
+		}
+	}
+	labels = kept
+	key := labelKey(labels)
+	if ts.After(a.times[key]) {
+		a.times[key] = ts
+	}
+	prev, found := a.values[key]
+	if !found {
+		a.keys = append(a.keys, key)
+		a.labels[key] = labels
+		a.values[key] = value
+		return
+	}
+	switch a.fn {
+	case aggregationSum:
+		a.values[key] = prev + value
+	case aggregationMax:
+		if value > prev {
+			a.values[key] = value
+		}
+	case aggregationMin:
+		if value < prev {
+			a.values[key] = value
+		}
+	case aggregationLast:
+		a.values[key] = value
+	}
+}
+
+// metrics returns one const metric per distinct label set, created by
+// newMetric
+func (a *aggregation) metrics(newMetric func(labels []string, value float64, ts time.Time) (prometheus.Metric, error)) ([]prometheus.Metric, error) {
+	metrics := make([]prometheus.Metric, 0, len(a.keys))
+	for _, key := range a.keys {
+		m, err := newMetric(a.labels[key], a.values[key], a.times[key])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create aggregated metric: %s", err)
+		}
+		if m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// CircuitBreaker stops running the queries of a connection for a cooldown
+// after a number of failed runs in a row, so a struggling database isn't hit
+// with connection attempts and queries on every run
+type CircuitBreaker struct {
+	Failures int           `yaml:"failures"` // failed runs in a row which open the circuit
+	Cooldown time.Duration `yaml:"cooldown"` // duration the circuit stays open
+}
+
+// circuitOpen reports whether the run on conn has to be skipped. Once the
+// cooldown is over the circuit is half-open, a single run decides whether it
+// closes again.
+func (j *Job) circuitOpen(conn *connection) bool {
+	if j.CircuitBreaker == nil {
+		return false
+	}
+	return time.Now().Before(conn.circuitUntil)
+}
+
+// recordRun counts a run of the job on conn for the circuit breaker. A run
+// failed if the connection failed or every query which ran failed.
+func (j *Job) recordRun(conn *connection, ok bool) {
+	if j.CircuitBreaker == nil {
+		return
+	}
+	if ok {
+		if conn.failedRuns >= j.CircuitBreaker.Failures {
+			level.Info(j.log).Log("msg", "Circuit closed", "host", conn.host, "db", conn.database)
+		}
+		conn.failedRuns = 0
+		j.stats.circuitOpen.WithLabelValues(j.Name, conn.host, conn.database).Set(0)
+		return
+	}
+	conn.failedRuns++
+	// a failed run while half-open opens the circuit again right away
+	if conn.failedRuns >= j.CircuitBreaker.Failures {
+		level.Warn(j.log).Log("msg", "Circuit open, skipping the connection", "failures", conn.failedRuns, "cooldown", j.CircuitBreaker.Cooldown, "host", conn.host, "db", conn.database)
+		conn.circuitUntil = time.Now().Add(j.CircuitBreaker.Cooldown)
+		j.stats.circuitOpen.WithLabelValues(j.Name, conn.host, conn.database).Set(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import "github.com/go-kit/kit/log/level"
+
+// foldedLabelValue replaces the values of a label which exceeded the
+// cardinality limit if folding is enabled
+const foldedLabelValue = "folded"
+
+// limitCardinality records the value of a label of the query and returns the
+// value to export and whether it was folded. Once a label has seen more than
+// the configured number of distinct values in a run of the job it's reported
+// in sql_exporter_label_cardinality_exceeded and, if folding is enabled, all
+// its values are replaced by foldedLabelValue for the rest of the run, see
+// resetCardinality. A limit of 0 disables the tracking.
+func (q *Query) limitCardinality(label, value string) (string, bool) {
+	if q.maxCardinality <= 0 {
+		return value, false
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.overLimit[label] {
+		if q.foldCardinality {
+			return foldedLabelValue, true
+		}
+		return value, false
+	}
+	if q.cardinality == nil {
+		q.cardinality = make(map[string]map[string]struct{})
+	}
+	values := q.cardinality[label]
+	if values == nil {
+		values = make(map[string]struct{})
+		q.cardinality[label] = values
+	}
+	values[value] = struct{}{}
+	if len(values) <= q.maxCardinality {
+		return value, false
+	}
+	// the values are no longer needed, only the fact that the limit was hit
+	if q.overLimit == nil {
+		q.overLimit = make(map[string]bool)
+	}
+	q.overLimit[label] = true
+	delete(q.cardinality, label)
+	level.Warn(q.log).Log("msg", "Label exceeded the cardinality limit", "label", label, "limit", q.maxCardinality, "fold", q.foldCardinality)
+	q.stats.labelCardinalityExceeded.WithLabelValues(q.job, q.Name, label).Set(1)
+	if q.foldCardinality {
+		return foldedLabelValue, true
+	}
+	return value, false
+}
+
+// resetCardinality starts counting the distinct label values of a new run of
+// the job, so a single spike doesn't fold a label forever. The labels which
+// stayed below the limit in the last run are cleared in
+// sql_exporter_label_cardinality_exceeded.
+func (q *Query) resetCardinality() {
+	if q.maxCardinality <= 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	for label := range q.exceeded {
+		if !q.overLimit[label] {
+			q.stats.labelCardinalityExceeded.WithLabelValues(q.job, q.Name, label).Set(0)
+		}
+	}
+	q.exceeded = q.overLimit
+	q.overLimit = nil
+	q.cardinality = nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFoldHighCardinality(t *testing.T) {
+	q := &Query{Name: "table_rows", Help: "Rows.", job: "test", log: log.NewNopLogger(), stats: newExporterStats(), maxCardinality: 2, foldCardinality: true}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_rows", "table"}
+	labelNames := q.labelNames(conn.labelNames, valueNames)
+	q.setDesc(labelNames)
+
+	for run := 0; run < 2; run++ {
+		q.resetCardinality()
+		agg := q.newFoldAggregation(labelNames)
+		var metrics []prometheus.Metric
+		// a and b are below the limit, c and d above it
+		for _, table := range []string{"a", "b", "c", "d"} {
+			res := map[string]interface{}{"metric_rows": "1", "table": table}
+			var err error
+			if metrics, err = q.updateMetrics(metrics, conn, res, valueNames, agg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		folded, err := agg.metrics(func(labels []string, value float64, ts time.Time) (prometheus.Metric, error) {
+			return q.newMetric(conn, labels, value, ts, time.Time{})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics = q.dropDuplicates(conn, append(metrics, folded...))
+
+		values := make(map[string]float64)
+		for _, m := range metrics {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			for _, lp := range pb.GetLabel() {
+				if lp.GetName() == "table" {
+					values[lp.GetValue()] = pb.GetGauge().GetValue()
+				}
+			}
+		}
+		want := map[string]float64{"a": 1, "b": 1, foldedLabelValue: 2}
+		if len(values) != len(want) {
+			t.Errorf("run %d: values %v, want %v", run, values, want)
+		}
+		for table, v := range want {
+			if values[table] != v {
+				t.Errorf("run %d: table %s = %v, want %v", run, table, values[table], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// charset maps the bytes from 0x80 of a single byte encoding to runes. The
+// bytes without an entry are the code point of the same number, as in
+// ISO-8859-1, and the bytes below 0x80 are ASCII.
+type charset map[byte]rune
+
+// charsets are the encodings of Connection.Charset by name. latin1 is
+// windows-1252 like in MySQL, which is a superset of ISO-8859-1 for text.
+var charsets = map[string]charset{
+	"latin1":       windows1252,
+	"iso-8859-1":   {},
+	"windows-1252": windows1252,
+	"cp1252":       windows1252,
+	"iso-8859-15":  iso885915,
+	"latin9":       iso885915,
+}
+
+// windows1252 differs from ISO-8859-1 in the C1 control codes, the bytes it
+// leaves undefined keep them. MySQL calls it latin1.
+var windows1252 = charset{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž',
+	0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+	0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
+
+// iso885915 replaces eight symbols of ISO-8859-1, e.g. the euro sign
+var iso885915 = charset{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+}
+
+// decode returns b as UTF-8
+func (cs charset) decode(b []byte) string {
+	ascii := true
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return string(b)
+	}
+	var sb strings.Builder
+	sb.Grow(len(b) + len(b)/2)
+	for _, c := range b {
+		switch r, found := cs[c]; {
+		case c < utf8.RuneSelf:
+			sb.WriteByte(c)
+		case found:
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(rune(c))
+		}
+	}
+	return sb.String()
+}
+
+// text returns a text column of c as UTF-8, decoded from Connection.Charset
+func (c *connection) text(b []uint8) string {
+	if c.charset == nil {
+		return string(b)
+	}
+	return c.charset.decode(b)
+}
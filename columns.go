@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// positionalValueColumn is the name of the value column selected by
+// value_column_index
+const positionalValueColumn = "metric_value"
+
+// handling of duplicate column names, see Query.DuplicateColumns
+const (
+	duplicateWarn   = "warn"
+	duplicateError  = "error"
+	duplicateRename = "rename"
+)
+
+// validDuplicateColumns reports whether s is a known duplicate_columns value
+func validDuplicateColumns(s string) bool {
+	switch s {
+	case "", duplicateWarn, duplicateError, duplicateRename:
+		return true
+	}
+	return false
+}
+
+// positional reports whether the columns of q are mapped by position, see
+// ValueColumnIndex
+func (q *Query) positional() bool {
+	return q.ValueColumnIndex != nil
+}
+
+// checkPositions validates the column positions of q on startup
+func (q *Query) checkPositions() error {
+	if !q.positional() {
+		if len(q.LabelColumnIndices) > 0 || len(q.LabelColumnNames) > 0 {
+			return fmt.Errorf("label_column_indices needs value_column_index")
+		}
+		return nil
+	}
+	if q.NameColumn != "" {
+		return fmt.Errorf("value_column_index can't be combined with name_column")
+	}
+	if len(q.LabelColumnNames) > 0 && len(q.LabelColumnNames) != len(q.LabelColumnIndices) {
+		return fmt.Errorf("label_column_names needs a name per label_column_indices entry")
+	}
+	seen := map[int]bool{*q.ValueColumnIndex: true}
+	for _, i := range append([]int{*q.ValueColumnIndex}, q.LabelColumnIndices...) {
+		if i < 0 {
+			return fmt.Errorf("invalid column index %d", i)
+		}
+	}
+	for _, i := range q.LabelColumnIndices {
+		if seen[i] {
+			return fmt.Errorf("column index %d is used twice", i)
+		}
+		seen[i] = true
+	}
+	names := map[string]bool{positionalValueColumn: true}
+	for _, name := range q.LabelColumnNames {
+		if !LabelNameRE.MatchString(name) || reservedLabel(name) || names[name] {
+			return fmt.Errorf("invalid label_column_names entry '%s'", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// positionColumns returns the column names of a result as the rest of the
+// query sees them. If the columns are mapped by position, the value column is
+// named metric_value, the label columns are named by label_column_names or
+// keep their names, and all other columns are dropped, i.e. get an empty name,
+// unless they are the timestamp or created column. The result is independent
+// of the names the database picks for expressions.
+func (q *Query) positionColumns(cols []string) ([]string, error) {
+	if !q.positional() {
+		return cols, nil
+	}
+	for _, i := range append([]int{*q.ValueColumnIndex}, q.LabelColumnIndices...) {
+		if i >= len(cols) {
+			return nil, fmt.Errorf("column index %d is out of range, the query returned %d columns", i, len(cols))
+		}
+	}
+	mapped := make([]string, len(cols))
+	for i, col := range cols {
+		if col == q.TimestampColumn || col == q.CreatedColumn {
+			mapped[i] = col
+		}
+	}
+	mapped[*q.ValueColumnIndex] = positionalValueColumn
+	for n, i := range q.LabelColumnIndices {
+		name := cols[i]
+		if n < len(q.LabelColumnNames) {
+			name = q.LabelColumnNames[n]
+		}
+		mapped[i] = name
+	}
+	return mapped, nil
+}
+
+// checkDuplicates handles the column names of a result which occur more than
+// once, e.g. the id of both tables of a join. By default they are logged and
+// only the last of those columns is used, with duplicate_columns error the
+// query fails and with rename the later ones get a suffix, e.g. id_2. cols are
+// the columns returned by positionColumns.
+func (q *Query) checkDuplicates(conn *connection, cols []string) ([]string, error) {
+	seen := make(map[string]int, len(cols))
+	var duplicates []string
+	for _, col := range cols {
+		if col == "" {
+			continue
+		}
+		seen[col]++
+		if seen[col] == 2 {
+			duplicates = append(duplicates, col)
+		}
+	}
+	if len(duplicates) == 0 {
+		return cols, nil
+	}
+	switch q.DuplicateColumns {
+	case duplicateError:
+		return nil, fmt.Errorf("duplicate column names %s", strings.Join(duplicates, ","))
+	case duplicateRename:
+		renamed := make([]string, len(cols))
+		n := make(map[string]int, len(duplicates))
+		for i, col := range cols {
+			renamed[i] = col
+			if col == "" || seen[col] < 2 {
+				continue
+			}
+			n[col]++
+			if n[col] > 1 {
+				renamed[i] = col + "_" + strconv.Itoa(n[col])
+			}
+		}
+		return renamed, nil
+	}
+	level.Warn(q.log).Log("msg", "Duplicate column names, only the last column is used", "columns", strings.Join(duplicates, ","), "host", conn.host, "db", conn.database)
+	// the earlier columns are dropped, like by positionColumns
+	last := make([]string, len(cols))
+	for i, col := range cols {
+		if seen[col]--; seen[col] == 0 {
+			last[i] = col
+		}
+	}
+	return last, nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/go-kit/kit/log"
 	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
@@ -35,43 +41,451 @@ func Read(path string) (File, error) {
 	return f, nil
 }
 
+// ReadDir parses all *.yml and *.yaml files in the given directory and merges
+// them into a single file object. Job names and query map keys must be unique
+// across all files.
+func ReadDir(dir string) (File, error) {
+	f := File{
+		Queries: make(map[string]string),
+	}
+
+	var paths []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return f, err
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return f, fmt.Errorf("no *.yml or *.yaml files found in %s", dir)
+	}
+	// jobs are always merged in the same order, whatever the extensions
+	sort.Strings(paths)
+	jobs := make(map[string]string)
+	for _, path := range paths {
+		part, err := Read(path)
+		if err != nil {
+			return f, fmt.Errorf("%s: %s", path, err)
+		}
+		for _, job := range part.Jobs {
+			if job == nil {
+				continue
+			}
+			if other, found := jobs[job.Name]; found {
+				return f, fmt.Errorf("%s: job %s already defined in %s", path, job.Name, other)
+			}
+			jobs[job.Name] = path
+			f.Jobs = append(f.Jobs, job)
+		}
+		for name, query := range part.Queries {
+			if _, found := f.Queries[name]; found {
+				return f, fmt.Errorf("%s: query %s already defined", path, name)
+			}
+			f.Queries[name] = query
+		}
+		// the global settings may be set in any of the files
+		if part.MaxLabelCardinality != 0 {
+			f.MaxLabelCardinality = part.MaxLabelCardinality
+		}
+		f.FoldHighCardinality = f.FoldHighCardinality || part.FoldHighCardinality
+		if part.GlobalMaxConnections != 0 {
+			f.GlobalMaxConnections = part.GlobalMaxConnections
+		}
+		if len(part.AllowedStatements) > 0 {
+			f.AllowedStatements = part.AllowedStatements
+		}
+		if part.MetricNameSanitizer != nil {
+			f.MetricNameSanitizer = part.MetricNameSanitizer
+		}
+	}
+	return f, nil
+}
+
+// ApplyOverlay patches f with the config file at path, e.g. with the DSNs and
+// intervals of an environment. Maps are merged recursively and list items with
+// a name, i.e. jobs and their queries, are merged with the item of the same
+// name or appended. All other values, including lists like connections, are
+// replaced. The result is parsed again as a whole.
+func ApplyOverlay(f File, path string) (File, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	var overlay interface{}
+	if err := yaml.Unmarshal(buf, &overlay); err != nil {
+		return f, fmt.Errorf("%s: %s", path, err)
+	}
+	// the base is merged in its parsed form, so it may come from several files
+	buf, err = yaml.Marshal(f)
+	if err != nil {
+		return f, err
+	}
+	var base interface{}
+	if err := yaml.Unmarshal(buf, &base); err != nil {
+		return f, err
+	}
+	buf, err = yaml.Marshal(mergeYAML(base, overlay))
+	if err != nil {
+		return f, err
+	}
+	merged := File{}
+	if err := yaml.Unmarshal(buf, &merged); err != nil {
+		return f, fmt.Errorf("%s: %s", path, err)
+	}
+	return merged, nil
+}
+
+// mergeYAML merges the overlay value into the base value, see ApplyOverlay
+func mergeYAML(base, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[interface{}]interface{}:
+		b, ok := base.(map[interface{}]interface{})
+		if !ok {
+			return overlay
+		}
+		for k, v := range o {
+			b[k] = mergeYAML(b[k], v)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !namedItems(o) || !namedItems(b) {
+			return overlay
+		}
+		for _, item := range o {
+			name := item.(map[interface{}]interface{})["name"]
+			found := false
+			for i, other := range b {
+				if other.(map[interface{}]interface{})["name"] == name {
+					b[i] = mergeYAML(other, item)
+					found = true
+					break
+				}
+			}
+			if !found {
+				b = append(b, item)
+			}
+		}
+		return b
+	}
+	return overlay
+}
+
+// namedItems reports whether all items of the list are maps with a name
+func namedItems(list []interface{}) bool {
+	for _, item := range list {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+		if _, found := m["name"]; !found {
+			return false
+		}
+	}
+	return true
+}
+
 // File is a collection of jobs
 type File struct {
-	Jobs    []*Job            `yaml:"jobs"`
-	Queries map[string]string `yaml:"queries"`
+	Jobs                 []*Job            `yaml:"jobs"`
+	Queries              map[string]string `yaml:"queries"`
+	MaxLabelCardinality  int               `yaml:"max_label_cardinality"`  // distinct values of a label of a query before it's reported
+	FoldHighCardinality  bool              `yaml:"fold_high_cardinality"`  // replace the values of labels over the limit
+	GlobalMaxConnections int               `yaml:"global_max_connections"` // queries running at once across all jobs and connections
+	AllowedStatements    []string          `yaml:"allowed_statements"`     // keywords the statements of all queries must start with, e.g. SELECT
+	MetricNameSanitizer  *NameSanitizer    `yaml:"metric_name_sanitizer"`  // replaces invalid characters of metric names, removes them by default
 }
 
 // Job is a collection of connections and queries
 type Job struct {
-	log         log.Logger
-	conns       []*connection
-	Name        string        `yaml:"name"`      // name of this job
-	KeepAlive   bool          `yaml:"keepalive"` // keep connection between runs?
-	Interval    time.Duration `yaml:"interval"`  // interval at which this job is run
-	Connections []string      `yaml:"connections"`
-	Queries     []*Query      `yaml:"queries"`
-	StartupSQL  []string      `yaml:"startup_sql"` // SQL executed on startup
+	log                log.Logger
+	connsLock          sync.RWMutex // guards conns, which discovery replaces while scrapes read them
+	conns              []*connection
+	stop               chan struct{}       // closed to stop Run, e.g. on a config reload
+	connLabels         []string            // sorted names of all connection labels of this job
+	maxCardinality     int                 // see File.MaxLabelCardinality
+	foldCardinality    bool                // see File.FoldHighCardinality
+	slots              *querySlots         // shared by all jobs, see File.GlobalMaxConnections
+	stats              *exporterStats      // metrics about the exporter, shared by all jobs
+	pools              *poolRegistry       // database handles, shared by all jobs
+	pauses             *pauseRegistry      // pauses requested through /-/pause, shared by all jobs
+	allowedStatements  []string            // see File.AllowedStatements
+	discovery          []*discoverySource  // connections with a databases query, see Connection.DatabasesQuery
+	nameSanitizer      *NameSanitizer      // see File.MetricNameSanitizer
+	executed           int64               // queries run by the current run, updated atomically
+	Name               string              `yaml:"name"`      // name of this job
+	Namespace          string              `yaml:"namespace"` // prefix of the metric names of the queries
+	KeepAlive          bool                `yaml:"keepalive"` // keep connection between runs?
+	Interval           time.Duration       `yaml:"interval"`  // interval at which this job is run
+	Connections        []Connection        `yaml:"connections"`
+	ConnectTimeout     time.Duration       `yaml:"connect_timeout"` // max duration to open each connection, see Connection.ConnectTimeout
+	Timeout            time.Duration       `yaml:"timeout"`         // max duration of a run, remaining queries are skipped
+	Queries            []*Query            `yaml:"queries"`
+	StartupSQL         []string            `yaml:"startup_sql"`         // SQL executed on startup
+	ReadOnly           bool                `yaml:"read_only"`           // run each query in a read-only transaction
+	Snapshot           bool                `yaml:"snapshot"`            // run all queries of a connection in one read-only transaction
+	CircuitBreaker     *CircuitBreaker     `yaml:"circuit_breaker"`     // skip failing connections for a while
+	MaintenanceWindows []MaintenanceWindow `yaml:"maintenance_windows"` // times the queries of all connections don't run
+}
+
+// Connection is a database connection URL. It may carry additional labels,
+// e.g. a shard or replica index, which are added to every metric collected
+// from this connection. Instead of an URL a template can be given, which is
+// expanded into one connection per host.
+type Connection struct {
+	URL                string              `yaml:"url"`
+	Labels             map[string]string   `yaml:"labels"`
+	Template           string              `yaml:"template"`            // URL with a {host} placeholder
+	Hosts              []string            `yaml:"hosts"`               // hosts the template is expanded for
+	SSLCert            string              `yaml:"sslcert"`             // client certificate file, PostgreSQL only
+	SSLKey             string              `yaml:"sslkey"`              // client private key file, PostgreSQL only
+	SSLRootCert        string              `yaml:"sslrootcert"`         // CA certificate file, PostgreSQL only
+	Proxy              string              `yaml:"proxy"`               // socks5://[user:password@]host:port to connect through
+	HostLabel          string              `yaml:"host_label"`          // value of the host label instead of the host of the URL
+	DatabaseLabel      string              `yaml:"database_label"`      // value of the database label instead of the database of the URL
+	UserLabel          string              `yaml:"user_label"`          // value of the user label instead of the user of the URL
+	KeepAliveInterval  time.Duration       `yaml:"keepalive_interval"`  // ping the connection this often in between runs
+	Route              string              `yaml:"route"`               // primary, standby or prefer_standby, see route_hosts
+	RouteHosts         []string            `yaml:"route_hosts"`         // hosts to choose from by route, replacing the host of the URL
+	Isolation          string              `yaml:"isolation"`           // isolation level of the transactions of the queries, see Query.Isolation
+	MaintenanceWindows []MaintenanceWindow `yaml:"maintenance_windows"` // times the queries of this connection don't run, besides the ones of the job
+	DatabasesQuery     string              `yaml:"databases_query"`     // query returning the databases of the server, each gets a connection of its own
+	DatabasesInterval  time.Duration       `yaml:"databases_interval"`  // how often the databases query runs, 5m by default
+	AllowQueries       []string            `yaml:"allow_queries"`       // names of the only queries which may run on this connection, glob patterns like top_*
+	DenyQueries        []string            `yaml:"deny_queries"`        // names of queries which never run on this connection, glob patterns like top_*
+	SetupQueries       []string            `yaml:"setup_queries"`       // statements run in the session of each query before it, e.g. SET search_path
+	Weight             int                 `yaml:"weight"`              // share of the runs of distributed queries, 1 by default, see Query.Distribute
+	Charset            string              `yaml:"charset"`             // encoding of the text columns returned as bytes, e.g. latin1, UTF-8 by default
+	ConnectTimeout     time.Duration       `yaml:"connect_timeout"`     // max duration to open this connection, the connect_timeout of the job by default
+}
+
+// UnmarshalYAML allows a connection to be given as a plain URL string
+func (c *Connection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.URL); err == nil {
+		return nil
+	}
+	type plain Connection
+	return unmarshal((*plain)(c))
+}
+
+// withTLSFiles adds the TLS certificate files of the connection to the query
+// parameters of u, where the PostgreSQL driver picks them up
+func (c Connection) withTLSFiles(u *url.URL) error {
+	if c.SSLCert == "" && c.SSLKey == "" && c.SSLRootCert == "" {
+		return nil
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("TLS certificate files are not supported for %s", u.Scheme)
+	}
+	params := u.Query()
+	for name, file := range map[string]string{
+		"sslcert":     c.SSLCert,
+		"sslkey":      c.SSLKey,
+		"sslrootcert": c.SSLRootCert,
+	} {
+		if file != "" {
+			params.Set(name, file)
+		}
+	}
+	u.RawQuery = params.Encode()
+	return nil
 }
 
 type connection struct {
-	conn     *sqlx.DB
-	url      *url.URL
-	driver   string
-	host     string
-	database string
-	user     string
+	conn         *sqlx.DB
+	pool         *pool // shared handle conn belongs to
+	url          *url.URL
+	proxy        *url.URL   // SOCKS5 proxy to connect through, if any
+	forward      *forwarder // local port forwarded through the proxy
+	driver       string
+	host         string
+	database     string
+	user         string
+	labelNames   []string                    // names of the connection labels, same for the whole job
+	labelValues  []string                    // values of the connection labels, in the same order
+	backoff      *backoff.ExponentialBackOff // delays reconnects after failures
+	retryAt      time.Time                   // no reconnect is attempted before
+	readOnly     bool                        // run each query in a read-only transaction, see Job.ReadOnly
+	tx           *stmtTx                     // snapshot of the current run, see Job.Snapshot
+	failedRuns   int                         // failed runs in a row, see Job.CircuitBreaker
+	circuitUntil time.Time                   // the connection is skipped until
+	keepAlive    time.Duration               // see Connection.KeepAliveInterval
+	pingAt       time.Time                   // next keep-alive ping
+	route        string                      // see Connection.Route
+	routeHosts   []string                    // see Connection.RouteHosts
+	fixedHost    bool                        // the host label is set by Connection.HostLabel
+	isolation    string                      // see Connection.Isolation
+	windows      []MaintenanceWindow         // of the job and the connection
+	allowQueries []string                    // see Connection.AllowQueries
+	denyQueries  []string                    // see Connection.DenyQueries
+	setup        []string                    // see Connection.SetupQueries
+	weight       int                         // see Connection.Weight
+	charset      charset                     // see Connection.Charset, nil for UTF-8
+	timeout      time.Duration               // max duration to open the connection, see Connection.ConnectTimeout
+	interval     time.Duration               // of the job, which shares the pool with other jobs, see poolRegistry.get
+	pools        *poolRegistry               // of the job
+	handleLock   sync.Mutex                  // guards conn, pool and host, which probes read outside of the run loop, see probeConn
+}
+
+// label returns the value of the given connection label
+func (c *connection) label(name string) string {
+	for i, n := range c.labelNames {
+		if n == name {
+			return c.labelValues[i]
+		}
+	}
+	return ""
+}
+
+// allows reports whether the query name may run on the connection, see
+// Connection.AllowQueries and DenyQueries. The deny list wins.
+func (c *connection) allows(name string) bool {
+	for _, pattern := range c.denyQueries {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(c.allowQueries) == 0 {
+		return true
+	}
+	for _, pattern := range c.allowQueries {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // Query is an SQL query that is executed on a connection
 type Query struct {
 	sync.Mutex
-	log      log.Logger
-	desc     *prometheus.Desc
-	metrics  map[*connection][]prometheus.Metric
-	Name     string   `yaml:"name"`      // the prometheus metric name
-	Help     string   `yaml:"help"`      // the prometheus metric help text
-	Labels   []string `yaml:"labels"`    // expose these columns as labels per gauge
-	Values   []string `yaml:"values"`    // expose each of these as an gauge
-	Query    string   `yaml:"query"`     // a literal query
-	QueryRef string   `yaml:"query_ref"` // references an query in the query map
+	log                log.Logger
+	job                string // name of the job this query belongs to
+	namespace          string // namespace of the job this query belongs to
+	desc               *prometheus.Desc
+	metrics            map[*connection][]prometheus.Metric
+	metricsBytes       map[*connection]int                          // estimated memory of the cached metrics, see metricBytes
+	rawValues          map[*connection][]rawValue                   // last row of each connection, see DebugRawValues
+	picked             *connection                                  // connection of the current run, see Distribute
+	credits            map[*connection]int                          // round-robin state, see Job.distribute
+	nameRE             *regexp.Regexp                               // compiled NameRegex
+	nameLabels         []string                                     // labels captured by nameRE
+	typesChecked       bool                                         // the column types were validated
+	columns            []string                                     // columns the descriptor was built for
+	skipped            map[*connection]int                          // runs skipped since the last sample, see SampleRate
+	plans              map[*connection]string                       // hash of the last plan, see TrackPlan
+	countDesc          *prometheus.Desc                             // descriptor of the _count metrics, see CountColumns
+	deltaDesc          *prometheus.Desc                             // descriptor of the _delta metrics, see Delta
+	reduceDesc         *prometheus.Desc                             // descriptor of the reduced metric, see Reduce
+	deltas             map[*connection]map[string]*deltaSeries      // previous values by label set, see Delta
+	valueLabels        []bool                                       // labels of metric columns, which are not part of the key of a series, see seriesKey
+	descLabels         []string                                     // variable label names of the descriptor
+	counts             map[*connection]map[string]*rowCount         // _count values by label set
+	maxCardinality     int                                          // see File.MaxLabelCardinality
+	foldCardinality    bool                                         // see File.FoldHighCardinality
+	nameSanitizer      *NameSanitizer                               // see File.MetricNameSanitizer
+	slots              *querySlots                                  // see File.GlobalMaxConnections
+	stats              *exporterStats                               // see Job.stats
+	cardinality        map[string]map[string]struct{}               // distinct values by label, see limitCardinality
+	overLimit          map[string]bool                              // labels which exceeded the cardinality limit in the current run
+	exceeded           map[string]bool                              // labels which exceeded the cardinality limit in the last run, see resetCardinality
+	constLabels        map[string]string                            // label of an expanded loop item, see Loop
+	cumulative         map[*connection]map[string]*cumulativeSeries // counter state by label set, see Cumulative
+	probeParams        map[string]string                            // parameters of a probe, see Params
+	loopParams         map[string]string                            // values bound by param in a loop template, see Loop
+	Name               string                                       `yaml:"name"`                  // the prometheus metric name
+	Help               string                                       `yaml:"help"`                  // the prometheus metric help text
+	Labels             []string                                     `yaml:"labels"`                // expose these columns as labels per gauge
+	Values             []string                                     `yaml:"values"`                // expose each of these as an gauge
+	Query              string                                       `yaml:"query"`                 // a literal query
+	QueryRef           string                                       `yaml:"query_ref"`             // references an query in the query map
+	Aggregation        string                                       `yaml:"aggregation"`           // fold rows with identical labels: sum, max, min or last
+	ValueMap           map[string]*ValueMap                         `yaml:"value_map"`             // translate the values of these label columns
+	LabelDefaults      map[string]string                            `yaml:"label_defaults"`        // label values for columns missing from the result
+	NullLabel          *string                                      `yaml:"null_label"`            // label value of NULL label columns, which fail the row if unset
+	EmptyLabel         string                                       `yaml:"empty_label"`           // label value of label columns which are an empty string
+	ExpectedLabels     map[string][]string                          `yaml:"expected_labels"`       // export 0 for the combinations of these label values without rows
+	TimeFormat         map[string]string                            `yaml:"time_format"`           // format of time label columns: rfc3339, date, unix or a Go layout
+	JSONPath           map[string]string                            `yaml:"json_path"`             // replace the values of these JSON columns by the field at a dotted path, e.g. stats.reads
+	ConnectionSelector map[string]string                            `yaml:"connection_selector"`   // only run on connections with these labels
+	TimestampColumn    string                                       `yaml:"timestamp_column"`      // take the sample timestamp from this column
+	RunMode            string                                       `yaml:"run"`                   // "once" runs the query only until it succeeded
+	NameColumn         string                                       `yaml:"name_column"`           // parse the metric name and labels from this column
+	NameRegex          string                                       `yaml:"name_regex"`            // regex applied to the name column
+	SanitizeLabels     bool                                         `yaml:"sanitize_labels"`       // replace invalid UTF-8 and strip control characters
+	MaxLabelLength     int                                          `yaml:"max_label_length"`      // truncate label values from columns to this many characters
+	LabelMaxLength     map[string]int                               `yaml:"label_max_length"`      // truncate the values of these labels to this many characters instead
+	TruncationSuffix   string                                       `yaml:"truncation_suffix"`     // appended to truncated label values, e.g. an ellipsis
+	ColLabel           *string                                      `yaml:"col_label"`             // name of the label holding the value column, empty disables it
+	NameTransform      *NameTransform                               `yaml:"name_transform"`        // transform the value column names in the col label
+	ValueColumnIndex   *int                                         `yaml:"value_column_index"`    // take the value from the column at this position, starting at 0, instead of by name
+	LabelColumnIndices []int                                        `yaml:"label_column_indices"`  // take the labels from the columns at these positions, see value_column_index
+	LabelColumnNames   []string                                     `yaml:"label_column_names"`    // names of the labels at label_column_indices, the column names by default
+	DuplicateColumns   string                                       `yaml:"duplicate_columns"`     // handling of duplicate column names: warn (default), error or rename
+	Format             string                                       `yaml:"format"`                // "single" exports the only column of a single row as is
+	SampleRate         int                                          `yaml:"sample_rate"`           // run only on every n-th run of the job
+	Priority           int                                          `yaml:"priority"`              // queries with a higher priority run first
+	EmptyResult        string                                       `yaml:"empty_result"`          // "ok" or "error" (default) if the query returns no rows
+	Streaming          bool                                         `yaml:"streaming"`             // fetch the result through a cursor on PostgreSQL
+	ExpectedColumns    []string                                     `yaml:"expected_columns"`      // columns the self-test expects the query to return
+	TrackPlan          bool                                         `yaml:"track_plan"`            // count changes of the query plan on PostgreSQL
+	ZeroRowsRetries    int                                          `yaml:"zero_rows_retries"`     // retry the query this many times if it returns no rows
+	ZeroRowsRetryDelay time.Duration                                `yaml:"zero_rows_retry_delay"` // delay between the retries of an empty result
+	DeadlockRetries    int                                          `yaml:"deadlock_retries"`      // retry the query this many times after a deadlock or serialization failure
+	DeadlockRetryDelay time.Duration                                `yaml:"deadlock_retry_delay"`  // delay between the retries of a deadlock
+	CountColumns       []string                                     `yaml:"count_columns"`         // also count the rows of these value columns in a _count counter
+	Loop               *QueryLoop                                   `yaml:"loop"`                  // expand the query once per item
+	Reduce             *QueryReduce                                 `yaml:"reduce"`                // export a column reduced over all rows
+	Unit               string                                       `yaml:"unit"`                  // unit of the metric in the OpenMetrics format, e.g. seconds
+	ResultHash         bool                                         `yaml:"result_hash"`           // export a hash of the result in sql_query_result_hash
+	ExportInfo         bool                                         `yaml:"export_info"`           // export sql_query_info with the metadata of the query
+	DebugRawValues     bool                                         `yaml:"debug_raw_values"`      // DEBUG ONLY: export the raw values of the last row, which may contain personal data
+	Cumulative         bool                                         `yaml:"cumulative"`            // export the values as counters which survive resets in the database
+	CreatedColumn      string                                       `yaml:"created_column"`        // take the creation time of cumulative counters from this column
+	NegativeCounters   string                                       `yaml:"negative_counters"`     // handling of negative values of cumulative counters: keep, clamp or reject
+	Untyped            bool                                         `yaml:"untyped"`               // export the values as untyped instead of gauges
+	Isolation          string                                       `yaml:"isolation"`             // run the query in a transaction with this isolation level, e.g. repeatable_read
+	Distribute         string                                       `yaml:"distribute"`            // "round_robin" runs the query on one of its connections per run, by their weight
+	RelabelConfigs     []RelabelRule                                `yaml:"relabel_configs"`       // rewrite or drop the labels of the metrics before they are cached
+	SetupQueries       []string                                     `yaml:"setup_queries"`         // statements run in the session of the query before it, e.g. SET statement_timeout
+	Delta              bool                                         `yaml:"delta"`                 // export the change since the last run with a _delta suffix
+	Params             map[string]string                            `yaml:"params"`                // defaults of the named parameters of the query, e.g. :tenant, set per probe
+}
+
+// QueryReduce reduces a column over all rows of a result into one metric
+// named after the query and the function, e.g. sql_latency_max
+type QueryReduce struct {
+	Column string `yaml:"column"`
+	Func   string `yaml:"func"` // sum, avg, max or min
+}
+
+// QueryLoop expands a query into one query per item. The query is a Go
+// template which is executed with the item as its data, e.g. {{ident .}} for
+// the name of a table or {{param .}} for a value, and the item is added as a
+// label, see parseQueryTemplate.
+type QueryLoop struct {
+	Label string   `yaml:"label"` // name of the label holding the item
+	Items []string `yaml:"items"`
+}
+
+// ValueMap translates the raw values of a label column, e.g. a numeric status
+// code, into more meaningful label values
+type ValueMap struct {
+	Values  map[string]string `yaml:"values"`  // raw value to label value
+	Default string            `yaml:"default"` // label value for unmapped values, keeps the raw value if empty
+}
+
+// translate returns the label value for the raw column value
+func (m *ValueMap) translate(raw string) string {
+	if m == nil {
+		return raw
+	}
+	if lv, found := m.Values[raw]; found {
+		return lv
+	}
+	if m.Default != "" {
+		return m.Default
+	}
+	return raw
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+)
+
+// reasons of sql_connection_error, see classifyConnError
+const (
+	connErrorAuth    = "auth"
+	connErrorNetwork = "network"
+	connErrorDNS     = "dns"
+	connErrorTLS     = "tls"
+	connErrorTimeout = "timeout"
+	connErrorOther   = "other"
+)
+
+// connErrorReasons are all reasons, each connection exports every one of them
+var connErrorReasons = []string{connErrorAuth, connErrorNetwork, connErrorDNS, connErrorTLS, connErrorTimeout, connErrorOther}
+
+// connErrors classify the errors of a driver which only it can tell, i.e.
+// rejected credentials and TLS setup errors, by driver name. They return an
+// empty string for the other errors. Like deadlockErrors they are registered
+// by the driver_*.go files.
+var connErrors = map[string]func(error) string{}
+
+// classifyConnError returns the reason why a connection to driver failed with
+// err
+func classifyConnError(driver string, err error) string {
+	if classify, found := connErrors[driver]; found {
+		if reason := classify(err); reason != "" {
+			return reason
+		}
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return connErrorTimeout
+		}
+		return connErrorDNS
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return connErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return connErrorTimeout
+	}
+	var (
+		recordErr    tls.RecordHeaderError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return connErrorTLS
+	}
+	// the handshake errors of crypto/tls are not exported
+	if strings.Contains(err.Error(), "tls: ") {
+		return connErrorTLS
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return connErrorNetwork
+	}
+	return connErrorOther
+}
+
+// setConnError exports the reason of a failed connect of c, or no reason if
+// err is nil
+func (c *connection) setConnError(job *Job, err error) {
+	reason := ""
+	if err != nil {
+		reason = classifyConnError(c.driver, err)
+	}
+	for _, r := range connErrorReasons {
+		value := 0.0
+		if r == reason {
+			value = 1
+		}
+		job.stats.connectionError.WithLabelValues(job.Name, c.host, c.database, r).Set(value)
+	}
+}
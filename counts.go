@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rowCount is the _count companion of a label set, see Query.CountColumns
+type rowCount struct {
+	labels []string
+	value  float64
+	seen   bool // seen in the current run
+}
+
+// setDesc builds the descriptor of the query and of its _count and _delta
+// companion metrics with the given label names and the label of its loop
+// item, if any. The relabel_configs only apply to the query descriptor.
+// It has to be called with the lock held once the query is running.
+func (q *Query) setDesc(labelNames []string) {
+	if q.Aggregation != "" || q.Cumulative {
+		// the labels of the metric columns are dropped, see aggregation and
+		// updateMetric, a counter must keep its series when its value changes
+		labelNames = withoutValueLabels(labelNames)
+	}
+	constLabels := q.descConstLabels()
+	relabeled, _, _ := relabel(q.RelabelConfigs, labelNames, nil)
+	q.desc = prometheus.NewDesc(q.metricName(), q.Help, relabeled, constLabels)
+	q.descLabels = labelNames
+	q.valueLabels = make([]bool, len(labelNames))
+	for i, name := range labelNames {
+		q.valueLabels[i] = strings.HasPrefix(name, "metric_")
+	}
+	if len(q.CountColumns) > 0 {
+		q.countDesc = prometheus.NewDesc(
+			q.metricName()+"_count",
+			"Number of rows observed for "+q.metricName()+".",
+			withoutValueLabels(labelNames),
+			constLabels,
+		)
+	}
+	if q.Delta {
+		q.deltaDesc = prometheus.NewDesc(
+			q.metricName()+"_delta",
+			"Change of "+q.metricName()+" since the last run.",
+			withoutValueLabels(labelNames),
+			constLabels,
+		)
+	}
+}
+
+// withoutValueLabels returns the label names without the ones of metric
+// columns
+func withoutValueLabels(labelNames []string) []string {
+	names := make([]string, 0, len(labelNames))
+	for _, name := range labelNames {
+		if !strings.HasPrefix(name, "metric_") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// withoutValues returns the label values without the ones of the metric
+// columns among valueNames, which come last, see Query.labelNames
+func withoutValues(labels, valueNames []string) []string {
+	kept := make([]string, 0, len(labels))
+	first := len(labels) - len(valueNames)
+	for i, lv := range labels {
+		if i < first || !strings.HasPrefix(valueNames[i-first], "metric_") {
+			kept = append(kept, lv)
+		}
+	}
+	return kept
+}
+
+// descConstLabels returns the constant labels of the metrics of the query,
+// the job and the label of its loop item, if any
+func (q *Query) descConstLabels() prometheus.Labels {
+	constLabels := prometheus.Labels{"sql_job": q.job}
+	for name, value := range q.constLabels {
+		constLabels[name] = value
+	}
+	return constLabels
+}
+
+// counted reports whether a _count metric is exported for valueName
+func (q *Query) counted(valueName string) bool {
+	for _, col := range q.CountColumns {
+		if col == valueName {
+			return true
+		}
+	}
+	return false
+}
+
+// resetCounts starts a new run of the query on conn
+func (q *Query) resetCounts(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	for _, c := range q.counts[conn] {
+		c.seen = false
+	}
+}
+
+// countRow increments the _count companion of the given label values. The
+// labels of the metric columns among valueNames, which come last, are left
+// out, so the rows are counted by label set and not by value.
+func (q *Query) countRow(conn *connection, labels, valueNames []string) {
+	labels = withoutValues(labels, valueNames)
+	key := labelKey(labels)
+	q.Lock()
+	defer q.Unlock()
+	if q.counts == nil {
+		q.counts = make(map[*connection]map[string]*rowCount)
+	}
+	if q.counts[conn] == nil {
+		q.counts[conn] = make(map[string]*rowCount)
+	}
+	c, found := q.counts[conn][key]
+	if !found {
+		c = &rowCount{labels: labels}
+		q.counts[conn][key] = c
+	}
+	c.value++
+	c.seen = true
+}
+
+// countMetrics returns the _count metrics of the label sets seen in the
+// current run. The counts of label sets which disappeared are dropped, so
+// they start over if the label set comes back.
+func (q *Query) countMetrics(conn *connection) ([]prometheus.Metric, error) {
+	q.Lock()
+	defer q.Unlock()
+	metrics := make([]prometheus.Metric, 0, len(q.counts[conn]))
+	for key, c := range q.counts[conn] {
+		if !c.seen {
+			delete(q.counts[conn], key)
+			continue
+		}
+		m, err := prometheus.NewConstMetric(q.countDesc, prometheus.CounterValue, c.value, c.labels...)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
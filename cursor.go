@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// cursorFetchSize is the number of rows fetched at once from a cursor
+const cursorFetchSize = 1000
+
+// resultRows is the result set of a query, either *sqlx.Rows or cursorRows
+type resultRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Columns() ([]string, error)
+	Err() error
+	Close() error
+}
+
+// cursorRows iterates over the result of a query through a server-side
+// cursor in a PostgreSQL transaction, which is fetched cursorFetchSize rows at
+// a time. This keeps the server from sending the whole result set at once.
+type cursorRows struct {
+	ctx     context.Context
+	db      sqlQueryer   // the transaction the cursor was declared in
+	end     func() error // ends the transaction if the cursor has its own
+	rows    *sql.Rows    // the current batch
+	fetched int          // rows of the current batch
+	err     error
+}
+
+// queryCursor declares a cursor for query and fetches the first batch. The
+// cursor is declared in the snapshot of the run, if any, or in a transaction
+// of its own.
+func queryCursor(ctx context.Context, conn *connection, isolation string, setup []string, query string) (*cursorRows, error) {
+	c := &cursorRows{ctx: ctx}
+	opts := conn.txOptions(isolation)
+	setup = conn.setupStatements(setup)
+	switch {
+	case conn.tx != nil:
+		c.db = conn.tx.conn
+	case opts.readOnly || opts.isolation != "" || len(setup) > 0:
+		tx, err := beginStmtTx(ctx, conn.conn.DB, conn.driver, opts, setup)
+		if err != nil {
+			return nil, err
+		}
+		c.db, c.end = tx.conn, tx.end
+	default:
+		tx, err := conn.conn.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.db, c.end = tx, tx.Rollback
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	if _, err := c.db.ExecContext(ctx, "DECLARE sql_exporter_cursor NO SCROLL CURSOR FOR "+query); err != nil {
+		c.endTx()
+		return nil, err
+	}
+	if err := c.fetch(); err != nil {
+		c.endTx()
+		return nil, err
+	}
+	return c, nil
+}
+
+// endTx ends the transaction of the cursor if it has its own
+func (c *cursorRows) endTx() error {
+	if c.end == nil {
+		return nil
+	}
+	return c.end()
+}
+
+func (c *cursorRows) fetch() error {
+	rows, err := c.db.QueryContext(c.ctx, fmt.Sprintf("FETCH %d FROM sql_exporter_cursor", cursorFetchSize))
+	if err != nil {
+		return err
+	}
+	c.rows = rows
+	c.fetched = 0
+	return nil
+}
+
+// Next advances to the next row, fetching the next batch if necessary
+func (c *cursorRows) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	if c.rows.Next() {
+		c.fetched++
+		return true
+	}
+	if c.err = c.rows.Err(); c.err != nil {
+		return false
+	}
+	// a short batch is the last one
+	if c.fetched < cursorFetchSize {
+		return false
+	}
+	c.rows.Close()
+	if c.err = c.fetch(); c.err != nil {
+		return false
+	}
+	return c.Next()
+}
+
+// Scan implements resultRows
+func (c *cursorRows) Scan(dest ...interface{}) error {
+	return c.rows.Scan(dest...)
+}
+
+// Columns implements resultRows
+func (c *cursorRows) Columns() ([]string, error) {
+	return c.rows.Columns()
+}
+
+// Err implements resultRows
+func (c *cursorRows) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.rows.Err()
+}
+
+// Close closes the current batch and ends the transaction, which also closes
+// the cursor. In a shared snapshot the cursor is closed explicitly, so the
+// next query can declare it again.
+func (c *cursorRows) Close() error {
+	c.rows.Close()
+	if c.end != nil {
+		return c.end()
+	}
+	_, err := c.db.ExecContext(context.Background(), "CLOSE sql_exporter_cursor")
+	return err
+}
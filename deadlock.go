@@ -0,0 +1,14 @@
+package main
+
+// deadlockErrors classify the errors of a driver which are safe to retry,
+// i.e. deadlocks and serialization failures, by driver name. They are
+// registered by the driver_*.go files, so a driver left out by a build tag
+// doesn't pull in its package.
+var deadlockErrors = map[string]func(error) bool{}
+
+// isDeadlock reports whether err of driver is a deadlock or a serialization
+// failure, see Query.DeadlockRetries
+func isDeadlock(driver string, err error) bool {
+	classify, found := deadlockErrors[driver]
+	return found && err != nil && classify(err)
+}
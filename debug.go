@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxDebugValueLength limits the raw values exported by debugRawValues, the
+// rest is cut off
+const maxDebugValueLength = 256
+
+// debugRawValueDesc describes a raw column value, see Query.DebugRawValues
+var debugRawValueDesc = prometheus.NewDesc(
+	"sql_exporter_debug_raw_value",
+	"DEBUG ONLY: Raw value and Go type of each column of the last row of a query, as returned by the driver, always 1.",
+	[]string{"sql_job", "query", "host", "database", "column", "type", "value"}, nil,
+)
+
+// rawValue is a column value of a row as returned by the driver
+type rawValue struct {
+	column string
+	typ    string
+	value  string
+}
+
+// debugRawValues returns the columns of a row sorted by name. Text is
+// quoted, so bytes which are not UTF-8 and whitespace are visible.
+func debugRawValues(res map[string]interface{}) []rawValue {
+	values := make([]rawValue, 0, len(res))
+	for col, i := range res {
+		v := rawValue{column: col, typ: fmt.Sprintf("%T", i)}
+		switch t := i.(type) {
+		case nil:
+			v.value = "NULL"
+		case []uint8:
+			v.value = strconv.Quote(truncateDebug(string(t)))
+		case string:
+			v.value = strconv.Quote(truncateDebug(t))
+		default:
+			v.value = strings.ToValidUTF8(truncateDebug(fmt.Sprint(t)), "\uFFFD")
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].column < values[j].column })
+	return values
+}
+
+// truncateDebug cuts s to maxDebugValueLength bytes
+func truncateDebug(s string) string {
+	if len(s) > maxDebugValueLength {
+		return s[:maxDebugValueLength]
+	}
+	return s
+}
+
+// collectRawValues exports the raw values of the last row of q on each
+// connection
+func collectRawValues(ch chan<- prometheus.Metric, job *Job, q *Query) {
+	q.Lock()
+	defer q.Unlock()
+	for conn, values := range q.rawValues {
+		for _, v := range values {
+			ch <- prometheus.MustNewConstMetric(debugRawValueDesc, prometheus.GaugeValue, 1, job.Name, q.Name, conn.host, conn.database, v.column, v.typ, v.value)
+		}
+	}
+}
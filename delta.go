@@ -0,0 +1,88 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// deltaSeries is the state of a series of a query with Delta
+type deltaSeries struct {
+	labels  []string // labels of the current run, without the ones of metric columns
+	last    float64  // value of the previous run
+	current float64  // value of the current run
+	hasLast bool     // false until the series was returned by two runs
+	seen    bool     // seen in the current run
+}
+
+// resetDeltas starts a new run of the query on conn
+func (q *Query) resetDeltas(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	for _, s := range q.deltas[conn] {
+		s.seen = false
+	}
+}
+
+// seriesLabels returns the given label values without the ones of metric
+// columns, since they hold the value, see updateMetric. It has to be called
+// with the lock held.
+func (q *Query) seriesLabels(labels []string) []string {
+	kept := make([]string, 0, len(labels))
+	for i, lv := range labels {
+		if i >= len(q.valueLabels) || !q.valueLabels[i] {
+			kept = append(kept, lv)
+		}
+	}
+	return kept
+}
+
+// seriesKey returns the key of the series of the given label values, see
+// seriesLabels. It has to be called with the lock held.
+func (q *Query) seriesKey(labels []string) string {
+	return labelKey(q.seriesLabels(labels))
+}
+
+// recordDelta records the value of a series in the current run
+func (q *Query) recordDelta(conn *connection, labels []string, value float64) {
+	q.Lock()
+	defer q.Unlock()
+	labels = q.seriesLabels(labels)
+	key := labelKey(labels)
+	if q.deltas == nil {
+		q.deltas = make(map[*connection]map[string]*deltaSeries)
+	}
+	if q.deltas[conn] == nil {
+		q.deltas[conn] = make(map[string]*deltaSeries)
+	}
+	s, found := q.deltas[conn][key]
+	if !found {
+		s = &deltaSeries{}
+		q.deltas[conn][key] = s
+	}
+	s.labels = labels
+	s.current = value
+	s.seen = true
+}
+
+// deltaMetrics returns the _delta metrics of the current run, the value of
+// each series minus its value of the previous run. Series which are returned
+// for the first time have no delta yet. Series which were not returned are
+// dropped and start over if they come back.
+func (q *Query) deltaMetrics(conn *connection) ([]prometheus.Metric, error) {
+	q.Lock()
+	defer q.Unlock()
+	metrics := make([]prometheus.Metric, 0, len(q.deltas[conn]))
+	for key, s := range q.deltas[conn] {
+		if !s.seen {
+			delete(q.deltas[conn], key)
+			continue
+		}
+		if s.hasLast {
+			m, err := prometheus.NewConstMetric(q.deltaDesc, prometheus.GaugeValue, s.current-s.last, s.labels...)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, m)
+		}
+		s.last = s.current
+		s.hasLast = true
+	}
+	return metrics, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// describe implements the describe command, which runs a query of the config
+// once to set up its descriptor and prints the metric name and labels, e.g.
+// to check the label order before deploying. The server is not started.
+func describe(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("describe", flag.ContinueOnError)
+	var (
+		configFile    = fs.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
+		configDir     = fs.String("config.dir", os.Getenv("CONFIG_DIR"), "Directory of SQL Exporter configuration files to merge. Overrides config.file.")
+		configOverlay = fs.String("config.overlay", os.Getenv("CONFIG_OVERLAY"), "SQL Exporter configuration file patched into the configuration.")
+		queryName     = fs.String("query", "", "Name of the query to describe.")
+		jobName       = fs.String("job", "", "Name of the job of the query, any job by default.")
+		timeout       = fs.Duration("timeout", 30*time.Second, "Timeout to connect and run the query.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *queryName == "" {
+		return fmt.Errorf("missing -query")
+	}
+	if *configFile == "" {
+		*configFile = "config.yml"
+	}
+	e := &Exporter{logger: log.NewNopLogger(), configFile: *configFile, configDir: *configDir, configOverlay: *configOverlay}
+	jobs, err := e.load()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, job := range jobs {
+		if *jobName != "" && job.Name != *jobName {
+			continue
+		}
+		for _, q := range job.Queries {
+			if q == nil || q.Name != *queryName {
+				continue
+			}
+			found = true
+			if err := describeQuery(out, job, q, *timeout); err != nil {
+				return fmt.Errorf("job %s: %s", job.Name, err)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("query %s not found", *queryName)
+	}
+	return nil
+}
+
+// describeQuery sets up the descriptor of q on the first connection of job
+// which q runs on and prints it
+func describeQuery(out io.Writer, job *Job, q *Query, timeout time.Duration) error {
+	job.initConns()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	job.discoverDatabases(ctx)
+	for _, conn := range job.conns {
+		if !q.selects(conn) {
+			continue
+		}
+		if err := conn.connect(job); err != nil {
+			return err
+		}
+		defer conn.close()
+		if err := q.SetDesc(ctx, conn); err != nil {
+			return err
+		}
+		constLabels := q.descConstLabels()
+		names := make([]string, 0, len(constLabels))
+		for name := range constLabels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			pairs[i] = fmt.Sprintf("%s=%q", name, constLabels[name])
+		}
+		fmt.Fprintf(out, "# described on host %s, database %s\n", conn.host, conn.database)
+		fmt.Fprintf(out, "name: %s\n", q.metricName())
+		fmt.Fprintf(out, "help: %s\n", q.Help)
+		fmt.Fprintf(out, "const_labels: {%s}\n", strings.Join(pairs, ", "))
+		variable, _, _ := relabel(q.RelabelConfigs, q.descLabels, nil)
+		fmt.Fprintf(out, "variable_labels: [%s]\n", strings.Join(variable, ", "))
+		return nil
+	}
+	return fmt.Errorf("query %s runs on none of the connections", q.Name)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultDatabasesInterval is the default of Connection.DatabasesInterval
+const defaultDatabasesInterval = 5 * time.Minute
+
+// discoverySource is a connection with a databases query and the connections
+// of the databases it returned, see Connection.DatabasesQuery
+type discoverySource struct {
+	conn      Connection
+	databases map[string]*connection // connections by database
+	next      time.Time              // time of the next discovery
+}
+
+// discoverDatabases runs the databases queries which are due and updates the
+// connections of the job with one connection per database each returned, see
+// Connection.DatabasesQuery. Databases which are new get a connection, the
+// connections of the ones which are gone are closed. Servers which are
+// unreachable keep their connections and are retried on the next run, as
+// are the ones left once ctx is done.
+func (j *Job) discoverDatabases(ctx context.Context) {
+	now := time.Now()
+	for _, src := range j.discovery {
+		if now.Before(src.next) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		u, err := url.Parse(src.conn.URL)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse URL", "url", src.conn.URL, "err", err)
+			continue
+		}
+		databases, err := j.databases(ctx, src.conn)
+		if err != nil {
+			level.Warn(j.log).Log("msg", "Failed to discover databases, retrying on the next run", "err", err, "host", u.Host)
+			continue
+		}
+		interval := src.conn.DatabasesInterval
+		if interval == 0 {
+			interval = defaultDatabasesInterval
+		}
+		src.next = now.Add(interval)
+		level.Debug(j.log).Log("msg", "Discovered databases", "databases", len(databases), "host", u.Host)
+		j.updateDiscovered(src, u, databases)
+	}
+}
+
+// updateDiscovered adds the connections of the new databases of src and
+// removes the ones of the databases which are gone
+func (j *Job) updateDiscovered(src *discoverySource, u *url.URL, databases []string) {
+	found := make(map[string]bool, len(databases))
+	var added []*connection
+	for _, database := range databases {
+		found[database] = true
+		if _, known := src.databases[database]; known {
+			continue
+		}
+		u.Path = "/" + database
+		discovered := src.conn
+		discovered.URL = u.String()
+		discovered.DatabasesQuery = ""
+		c := j.newConnection(discovered)
+		if c == nil {
+			continue
+		}
+		src.databases[database] = c
+		added = append(added, c)
+	}
+	removed := make(map[*connection]bool)
+	for database, c := range src.databases {
+		if !found[database] {
+			level.Info(j.log).Log("msg", "Database is gone, dropping its connection", "host", c.host, "db", c.database)
+			removed[c] = true
+			delete(src.databases, database)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	conns := make([]*connection, 0, len(j.conns)+len(added))
+	for _, c := range j.conns {
+		if !removed[c] {
+			conns = append(conns, c)
+		}
+	}
+	j.setConnections(append(conns, added...))
+	for c := range removed {
+		j.forget(c)
+	}
+}
+
+// forget closes a connection which was removed from the job and drops its
+// cached metrics and state
+func (j *Job) forget(c *connection) {
+	c.close()
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		q.Lock()
+		delete(q.metrics, c)
+		delete(q.metricsBytes, c)
+		delete(q.rawValues, c)
+		delete(q.credits, c)
+		delete(q.skipped, c)
+		delete(q.plans, c)
+		delete(q.deltas, c)
+		delete(q.counts, c)
+		delete(q.cumulative, c)
+		if q.picked == c {
+			q.picked = nil
+		}
+		q.Unlock()
+		j.stats.queryUp.DeleteLabelValues(j.Name, q.Name, c.host, c.database)
+		j.stats.queryLastSuccess.DeleteLabelValues(j.Name, q.Name, c.host, c.database)
+		j.stats.querySeries.DeleteLabelValues(j.Name, q.Name, c.host, c.database)
+	}
+	j.stats.connectionUp.DeleteLabelValues(j.Name, c.host, c.database)
+	j.stats.connectionLastRun.DeleteLabelValues(j.Name, c.host, c.database)
+	for _, reason := range connErrorReasons {
+		j.stats.connectionError.DeleteLabelValues(j.Name, c.host, c.database, reason)
+	}
+}
+
+// databases runs the databases query of conn on the database of its URL and
+// returns the names in the first column. Connecting and the query are bounded
+// by ctx as well as by the connect timeout of conn.
+func (j *Job) databases(ctx context.Context, conn Connection) ([]string, error) {
+	c := j.newConnection(conn)
+	if c == nil {
+		return nil, fmt.Errorf("invalid connection")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		if c.timeout <= 0 || left < c.timeout {
+			c.timeout = left
+		}
+	}
+	if err := c.connect(j); err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if timeout := c.timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	rows, err := c.conn.QueryContext(ctx, conn.DatabasesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) != 1 {
+		return nil, fmt.Errorf("databases_query must return one column, got %d", len(cols))
+	}
+	var databases []string
+	for rows.Next() {
+		var database string
+		if err := rows.Scan(&database); err != nil {
+			return nil, err
+		}
+		databases = append(databases, database)
+	}
+	return databases, rows.Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// distributeRoundRobin runs a query on one connection per run, see
+// Query.Distribute
+const distributeRoundRobin = "round_robin"
+
+// checkDistribute validates Query.Distribute on startup
+func (q *Query) checkDistribute() error {
+	switch q.Distribute {
+	case "":
+		return nil
+	case distributeRoundRobin:
+	default:
+		return fmt.Errorf("unknown distribute '%s'", q.Distribute)
+	}
+	// the cached metrics of a connection would outlive its turn
+	if q.RunMode == runModeOnce || q.SampleRate > 1 {
+		return fmt.Errorf("distribute can't be combined with run once or sample_rate")
+	}
+	return nil
+}
+
+// runsOn reports whether q runs on conn in the current run, i.e. if it
+// selects conn and conn is its pick if the query is distributed
+func (q *Query) runsOn(conn *connection) bool {
+	return q.selects(conn) && (q.Distribute == "" || q.picked == conn)
+}
+
+// distribute picks the connection of each distributed query for the next
+// run by smooth weighted round-robin: every candidate gains its weight, the
+// one with the most credit is picked and pays the total weight. Connections
+// which are paused, behind an open circuit or waiting to reconnect are left
+// out while others are available.
+func (j *Job) distribute() {
+	now := time.Now()
+	for _, q := range j.Queries {
+		if q == nil || q.Distribute == "" {
+			continue
+		}
+		var candidates, all []*connection
+		for _, conn := range j.conns {
+			if !q.selects(conn) {
+				continue
+			}
+			all = append(all, conn)
+			if !j.paused(conn) && !j.circuitOpen(conn) && !now.Before(conn.retryAt) {
+				candidates = append(candidates, conn)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = all
+		}
+		if q.credits == nil {
+			q.credits = make(map[*connection]int)
+		}
+		var picked *connection
+		total := 0
+		for _, conn := range candidates {
+			q.credits[conn] += conn.weight
+			total += conn.weight
+			if picked == nil || q.credits[conn] > q.credits[picked] {
+				picked = conn
+			}
+		}
+		if picked != nil {
+			q.credits[picked] -= total
+		}
+		q.picked = picked
+	}
+}
+
+// dropOtherPicks removes the cached metrics of the connections q ran on in
+// earlier runs once it succeeded on conn, so there is one series per run
+func (q *Query) dropOtherPicks(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	for c := range q.metrics {
+		if c != conn {
+			delete(q.metrics, c)
+			delete(q.metricsBytes, c)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !no_clickhouse
+// +build !no_clickhouse
+
+package main
+
+import _ "github.com/kshvakov/clickhouse" // register the ClickHouse driver
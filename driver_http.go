@@ -0,0 +1,130 @@
+//go:build !no_http
+// +build !no_http
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerSource("http", httpSource{})
+	registerSource("https", httpSource{})
+}
+
+// httpSource gets JSON from an HTTP endpoint, e.g. the stats of a service.
+// The query is the path relative to the connection URL. An array of objects
+// has a row per object and a single object is one row. Numbers and booleans,
+// as 1 or 0, are values in columns named metric_<key>, all other fields are
+// labels and nested ones are kept as JSON. Any other document is one row
+// with the column metric_value. All columns are text, since they are
+// exported as labels as well, see updateMetric.
+type httpSource struct{}
+
+type httpConn struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// maxHTTPResponse limits the size of a response in bytes
+const maxHTTPResponse = 64 << 20
+
+func (httpSource) open(dsn string) (sourceConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &httpConn{base: u, client: &http.Client{}}, nil
+}
+
+// query implements sourceConn
+func (c *httpConn) query(ctx context.Context, query string) ([]string, [][]driver.Value, error) {
+	ref, err := url.Parse(strings.TrimSpace(query))
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxHTTPResponse))
+	// the numbers are kept as text, so they are parsed like column values
+	dec.UseNumber()
+	var body interface{}
+	if err := dec.Decode(&body); err != nil {
+		return nil, nil, err
+	}
+	cols, rows := jsonRows(body)
+	return cols, rows, nil
+}
+
+func (c *httpConn) Close() error {
+	return nil
+}
+
+// jsonRows converts a JSON document to rows, see httpSource
+func jsonRows(body interface{}) ([]string, [][]driver.Value) {
+	var objects []map[string]interface{}
+	switch b := body.(type) {
+	case []interface{}:
+		for _, elem := range b {
+			obj, ok := elem.(map[string]interface{})
+			if !ok {
+				return []string{"metric_value"}, [][]driver.Value{{jsonValue(body)}}
+			}
+			objects = append(objects, obj)
+		}
+	case map[string]interface{}:
+		objects = append(objects, b)
+	default:
+		return []string{"metric_value"}, [][]driver.Value{{jsonValue(body)}}
+	}
+	// the columns are the keys of all objects, missing ones are empty
+	fields := make([]map[string]driver.Value, len(objects))
+	seen := make(map[string]bool)
+	var cols []string
+	for i, obj := range objects {
+		fields[i] = make(map[string]driver.Value, len(obj))
+		for key, v := range obj {
+			switch v.(type) {
+			case json.Number, bool:
+				key = "metric_" + key
+			}
+			fields[i][key] = jsonValue(v)
+			if !seen[key] {
+				seen[key] = true
+				cols = append(cols, key)
+			}
+		}
+	}
+	sort.Strings(cols)
+	rows := make([][]driver.Value, len(objects))
+	for i := range objects {
+		row := make([]driver.Value, len(cols))
+		for j, col := range cols {
+			row[j] = ""
+			if v, found := fields[i][col]; found {
+				row[j] = v
+			}
+		}
+		rows[i] = row
+	}
+	return cols, rows
+}
@@ -0,0 +1,31 @@
+//go:build !no_mysql
+// +build !no_mysql
+
+package main
+
+import "github.com/go-sql-driver/mysql" // register the MySQL driver
+
+func init() {
+	deadlockErrors["mysql"] = func(err error) bool {
+		// ER_LOCK_DEADLOCK
+		e, ok := err.(*mysql.MySQLError)
+		return ok && e.Number == 1213
+	}
+	connErrors["mysql"] = func(err error) string {
+		if e, ok := err.(*mysql.MySQLError); ok {
+			switch e.Number {
+			// ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR and
+			// ER_ACCESS_DENIED_NO_PASSWORD_ERROR
+			case 1044, 1045, 1698:
+				return connErrorAuth
+			}
+		}
+		switch err {
+		case mysql.ErrCleartextPassword, mysql.ErrNativePassword, mysql.ErrOldPassword:
+			return connErrorAuth
+		case mysql.ErrNoTLS:
+			return connErrorTLS
+		}
+		return ""
+	}
+}
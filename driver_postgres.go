@@ -0,0 +1,32 @@
+//go:build !no_postgres
+// +build !no_postgres
+
+package main
+
+import "github.com/lib/pq" // register the PostgreSQL driver
+
+func init() {
+	deadlockErrors["postgres"] = pqDeadlock
+	deadlockErrors["postgresql"] = pqDeadlock
+	connErrors["postgres"] = pqConnError
+	connErrors["postgresql"] = pqConnError
+}
+
+// pqDeadlock reports whether err is a deadlock_detected or a
+// serialization_failure
+func pqDeadlock(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && (e.Code == "40P01" || e.Code == "40001")
+}
+
+// pqConnError classifies the errors of class 28, invalid authorization, e.g.
+// a wrong password, and the SSL setup errors
+func pqConnError(err error) string {
+	if e, ok := err.(*pq.Error); ok && e.Code.Class() == "28" {
+		return connErrorAuth
+	}
+	if err == pq.ErrSSLNotSupported || err == pq.ErrSSLKeyHasWorldPermissions {
+		return connErrorTLS
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+//go:build !no_redis
+// +build !no_redis
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSource("redis", redisSource{})
+}
+
+// redisSource runs Redis commands, e.g. redis://:password@host:6379/0. The
+// result of INFO has a row per field with the columns section, key and
+// metric_value, every other reply a row per element with the column
+// metric_value.
+type redisSource struct{}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (redisSource) open(dsn string) (sourceConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	var setup [][]string
+	if pass, found := u.User.Password(); found {
+		if name := u.User.Username(); name != "" {
+			setup = append(setup, []string{"AUTH", name, pass})
+		} else {
+			setup = append(setup, []string{"AUTH", pass})
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		if _, err := c.do(context.Background(), args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// query implements sourceConn, the arguments of a command are separated by
+// whitespace
+func (c *redisConn) query(ctx context.Context, query string) ([]string, [][]driver.Value, error) {
+	args := strings.Fields(query)
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("empty command")
+	}
+	reply, err := c.do(ctx, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.EqualFold(args[0], "INFO") {
+		if s, ok := reply.(string); ok {
+			return []string{"section", "key", "metric_value"}, parseRedisInfo(s), nil
+		}
+	}
+	var rows [][]driver.Value
+	if elems, ok := reply.([]interface{}); ok {
+		for _, elem := range elems {
+			rows = append(rows, []driver.Value{redisValue(elem)})
+		}
+	} else {
+		rows = append(rows, []driver.Value{redisValue(reply)})
+	}
+	return []string{"metric_value"}, rows, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(ctx context.Context, args []string) (interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblocks the pending read
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply of the Redis protocol, which is a string, an
+// int64, nil or a slice of those. Error replies are returned as errors.
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, rejectedError{line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			elem, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// redisValue converts an element of a reply to a text column value, since
+// the columns are exported as labels as well. Nested arrays are joined with
+// spaces.
+func redisValue(reply interface{}) driver.Value {
+	switch r := reply.(type) {
+	case nil:
+		return nil
+	case int64:
+		return strconv.FormatInt(r, 10)
+	case []interface{}:
+		parts := make([]string, len(r))
+		for i, elem := range r {
+			if v := redisValue(elem); v != nil {
+				parts[i] = v.(string)
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	return reply
+}
+
+// parseRedisInfo returns a row per field of the INFO reply, the fields
+// follow the "# Section" line they belong to
+func parseRedisInfo(info string) [][]driver.Value {
+	var rows [][]driver.Value
+	section := ""
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			section = strings.ToLower(strings.TrimSpace(line[1:]))
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		rows = append(rows, []driver.Value{section, line[:i], line[i+1:]})
+	}
+	return rows
+}
@@ -0,0 +1,25 @@
+//go:build !no_sqlserver
+// +build !no_sqlserver
+
+package main
+
+import mssql "github.com/denisenkom/go-mssqldb" // register the MS-SQL driver
+
+func init() {
+	deadlock := func(err error) bool {
+		// chosen as the deadlock victim
+		e, ok := err.(mssql.Error)
+		return ok && e.Number == 1205
+	}
+	deadlockErrors["sqlserver"] = deadlock
+	deadlockErrors["mssql"] = deadlock
+	connError := func(err error) string {
+		// login failed, e.g. a wrong password or an expired one
+		if e, ok := err.(mssql.Error); ok && (e.Number == 18456 || e.Number == 18487 || e.Number == 18488) {
+			return connErrorAuth
+		}
+		return ""
+	}
+	connErrors["sqlserver"] = connError
+	connErrors["mssql"] = connError
+}
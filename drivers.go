@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// The scheme of a connection URL is the name of the database/sql driver, the
+// URL is passed to the driver as its DSN. Drivers which are not built in, e.g.
+// of an in-house database, are registered by a blank import in a new file of
+// this package, see the README.
+
+// excludeTags are the build tags which leave out a built-in driver, e.g. to
+// build a smaller binary, see the driver_*.go files
+var excludeTags = map[string]string{
+	"postgres":   "no_postgres",
+	"mysql":      "no_mysql",
+	"sqlserver":  "no_sqlserver",
+	"mssql":      "no_sqlserver",
+	"clickhouse": "no_clickhouse",
+	"redis":      "no_redis",
+	"http":       "no_http",
+	"https":      "no_http",
+}
+
+// checkDriver returns an error if no database/sql driver is registered with
+// the given name
+func checkDriver(name string) error {
+	drivers := sql.Drivers()
+	for _, driver := range drivers {
+		if driver == name {
+			return nil
+		}
+	}
+	if tag, found := excludeTags[name]; found {
+		return fmt.Errorf("driver '%s' not compiled into this build, it was built with the %s tag", name, tag)
+	}
+	return fmt.Errorf("unknown driver '%s', registered drivers are %s", name, strings.Join(drivers, ", "))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// checkExpectedLabels validates Query.ExpectedLabels on startup
+func (q *Query) checkExpectedLabels() error {
+	if len(q.ExpectedLabels) == 0 {
+		return nil
+	}
+	if q.Format != "" || q.NameColumn != "" {
+		return fmt.Errorf("expected_labels can't be combined with format or name_column")
+	}
+	if len(q.CountColumns) > 0 {
+		return fmt.Errorf("expected_labels can't be combined with count_columns")
+	}
+	for col, values := range q.ExpectedLabels {
+		if strings.HasPrefix(col, "metric_") || col == q.TimestampColumn || col == q.CreatedColumn {
+			return fmt.Errorf("expected_labels entry '%s' is not a label column", col)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("expected_labels entry '%s' has no values", col)
+		}
+	}
+	return nil
+}
+
+// expectedSeen records the combinations of the expected label values which
+// were returned, see Query.ExpectedLabels
+type expectedSeen struct {
+	cols []string // sorted expected label columns
+	seen map[string]bool
+}
+
+// newExpectedSeen returns nil if q has no expected labels
+func (q *Query) newExpectedSeen() *expectedSeen {
+	if len(q.ExpectedLabels) == 0 {
+		return nil
+	}
+	cols := make([]string, 0, len(q.ExpectedLabels))
+	for col := range q.ExpectedLabels {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return &expectedSeen{cols: cols, seen: make(map[string]bool)}
+}
+
+// add records the expected label values of a row
+func (s *expectedSeen) add(res map[string]interface{}) {
+	values := make([]string, len(s.cols))
+	for i, col := range s.cols {
+		switch v := res[col].(type) {
+		case nil:
+		case string:
+			values[i] = v
+		case []uint8:
+			values[i] = string(v)
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	s.seen[labelKey(values)] = true
+}
+
+// missing returns a row with the value 0 in every metric column for each
+// combination of the expected label values which wasn't returned. The other
+// label columns are missing, so they get their label_defaults.
+func (s *expectedSeen) missing(q *Query, valueNames []string) []map[string]interface{} {
+	var rows []map[string]interface{}
+	values := make([]string, len(s.cols))
+	var expand func(i int)
+	expand = func(i int) {
+		if i < len(s.cols) {
+			for _, v := range q.ExpectedLabels[s.cols[i]] {
+				values[i] = v
+				expand(i + 1)
+			}
+			return
+		}
+		if s.seen[labelKey(values)] {
+			return
+		}
+		row := make(map[string]interface{}, len(valueNames)+2)
+		for _, name := range valueNames {
+			if strings.HasPrefix(name, "metric_") {
+				// text, since the metric columns are labels as well
+				row[name] = "0"
+			}
+		}
+		for i, col := range s.cols {
+			row[col] = values[i]
+		}
+		if q.TimestampColumn != "" {
+			row[q.TimestampColumn] = nil
+		}
+		if q.CreatedColumn != "" {
+			row[q.CreatedColumn] = nil
+		}
+		rows = append(rows, row)
+	}
+	expand(0)
+	return rows
+}
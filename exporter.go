@@ -1,52 +1,220 @@
 package main
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 // Exporter collects SQL metrics. It implements prometheus.Collector.
 type Exporter struct {
-	jobs   []*Job
-	logger log.Logger
+	sync.RWMutex  // protects jobs during a reload
+	jobs          []*Job
+	logger        log.Logger
+	configFile    string
+	configDir     string
+	configOverlay string // patched into the config, see ApplyOverlay
+	check         bool
+	stats         *exporterStats // metrics about the exporter itself
+	pools         *poolRegistry  // database handles of the jobs, which outlive a reload
+	pauses        *pauseRegistry
 }
 
-// NewExporter returns a new SQL Exporter for the provided config.
-func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
+// NewExporter returns a new SQL Exporter for the provided config. If configDir
+// is set, all config files in it are merged and configFile is ignored. If
+// configOverlay is set, it's patched into the config. If check is set, the
+// query descriptors are verified against the databases before the jobs are
+// started, see Job.Check.
+func NewExporter(logger log.Logger, configFile, configDir, configOverlay string, check bool) (*Exporter, error) {
 	if configFile == "" {
 		configFile = "config.yml"
 	}
 
-	// read config
-	cfg, err := Read(configFile)
+	exp := &Exporter{
+		logger:        logger,
+		configFile:    configFile,
+		configDir:     configDir,
+		configOverlay: configOverlay,
+		check:         check,
+		stats:         newExporterStats(),
+		pools:         newPoolRegistry(),
+		pauses:        newPauseRegistry(),
+	}
+	jobs, err := exp.load()
 	if err != nil {
 		return nil, err
 	}
+	exp.jobs = jobs
+	exp.stats.configLastReloadSuccess.SetToCurrentTime()
+
+	// dispatch all jobs
+	for _, job := range exp.jobs {
+		go job.Run()
+	}
 
+	return exp, nil
+}
+
+// NewCollector returns an Exporter for a parsed config which collects the
+// metrics of its queries, e.g. to register it with a custom registry instead
+// of the default one. The metrics about the exporter itself, e.g.
+// sql_query_up, are registered with reg. They, the database handles and the
+// pauses are not shared with other exporters. The jobs are started right
+// away. Reload is not supported since there is no config file.
+func NewCollector(logger log.Logger, cfg File, check bool, reg prometheus.Registerer) (*Exporter, error) {
 	exp := &Exporter{
-		jobs:   make([]*Job, 0, len(cfg.Jobs)),
 		logger: logger,
+		check:  check,
+		stats:  newExporterStats(),
+		pools:  newPoolRegistry(),
+		pauses: newPauseRegistry(),
+	}
+	if err := exp.stats.register(reg); err != nil {
+		return nil, err
 	}
+	jobs, err := exp.initJobs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	exp.jobs = jobs
+	for _, job := range exp.jobs {
+		go job.Run()
+	}
+	return exp, nil
+}
 
-	// dispatch all jobs
+// load reads the config and initializes its jobs without starting them
+func (e *Exporter) load() ([]*Job, error) {
+	// read config
+	var cfg File
+	var err error
+	if e.configDir != "" {
+		cfg, err = ReadDir(e.configDir)
+	} else {
+		cfg, err = Read(e.configFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.configOverlay != "" {
+		cfg, err = ApplyOverlay(cfg, e.configOverlay)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e.initJobs(cfg)
+}
+
+// initJobs initializes the jobs of cfg without starting them
+func (e *Exporter) initJobs(cfg File) ([]*Job, error) {
+	if cfg.GlobalMaxConnections < 0 {
+		return nil, fmt.Errorf("negative global_max_connections %d", cfg.GlobalMaxConnections)
+	}
+	slots := newQuerySlots(cfg.GlobalMaxConnections, e.stats.queriesWaiting)
+	sanitizer := defaultNameSanitizer
+	if cfg.MetricNameSanitizer != nil {
+		sanitizer = cfg.MetricNameSanitizer
+		if err := sanitizer.compile(); err != nil {
+			return nil, err
+		}
+	}
+	// initialize all jobs
+	jobs := make([]*Job, 0, len(cfg.Jobs))
 	for _, job := range cfg.Jobs {
 		if job == nil {
 			continue
 		}
-		if err := job.Init(logger, cfg.Queries); err != nil {
-			level.Warn(logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
+		job.maxCardinality = cfg.MaxLabelCardinality
+		job.foldCardinality = cfg.FoldHighCardinality
+		job.slots = slots
+		job.stats = e.stats
+		job.pools = e.pools
+		job.pauses = e.pauses
+		job.allowedStatements = cfg.AllowedStatements
+		job.nameSanitizer = sanitizer
+		if err := job.Init(e.logger, cfg.Queries); err != nil {
+			level.Warn(e.logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
 			continue
 		}
-		exp.jobs = append(exp.jobs, job)
+		jobs = append(jobs, job)
+	}
+
+	// a throwaway registry catches any descriptor which would break the scrape
+	if e.check {
+		reg := prometheus.NewRegistry()
+		for _, job := range jobs {
+			if err := job.Check(reg); err != nil {
+				for _, job := range jobs {
+					job.closeConns()
+				}
+				return nil, fmt.Errorf("job %s: %s", job.Name, err)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// Reload replaces the jobs with the ones of the current config. If the config
+// is invalid the running jobs are kept.
+func (e *Exporter) Reload() error {
+	if e.configFile == "" && e.configDir == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+	jobs, err := e.load()
+	if err != nil {
+		e.stats.configReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+	e.Lock()
+	old := e.jobs
+	e.jobs = jobs
+	e.Unlock()
+	for _, job := range old {
+		job.Stop()
+	}
+	for _, job := range jobs {
 		go job.Run()
 	}
+	e.stats.configReloads.WithLabelValues("success").Inc()
+	e.stats.configLastReloadSuccess.SetToCurrentTime()
+	return nil
+}
 
-	return exp, nil
+// Units returns the units of the query metrics by metric name, see
+// Query.Unit
+func (e *Exporter) Units() map[string]string {
+	e.RLock()
+	defer e.RUnlock()
+	units := make(map[string]string)
+	for _, job := range e.jobs {
+		for _, q := range job.Queries {
+			if q != nil && q.Unit != "" {
+				units[q.metricName()] = q.Unit
+			}
+		}
+	}
+	return units
 }
 
 // Describe implements prometheus.Collector
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+	ch <- cachedMetricsDesc
+	ch <- cacheBytesDesc
+	ch <- queryInfoDesc
+	ch <- debugRawValueDesc
+	e.RLock()
+	defer e.RUnlock()
 	for _, job := range e.jobs {
 		if job == nil {
 			continue
@@ -55,17 +223,30 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 			if query == nil {
 				continue
 			}
-			if query.desc == nil {
+			// the descriptors are rebuilt when the columns change
+			query.Lock()
+			descs := []*prometheus.Desc{query.desc, query.countDesc, query.deltaDesc, query.reduceDesc}
+			query.Unlock()
+			if descs[0] == nil {
 				level.Error(e.logger).Log("msg", "Query has no descriptor", "query", query.Name)
 				continue
 			}
-			ch <- query.desc
+			for _, desc := range descs {
+				if desc != nil {
+					ch <- desc
+				}
+			}
 		}
 	}
 }
 
 // Collect implements prometheus.Collector
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.stats.activeScrapes.Inc()
+	defer e.stats.activeScrapes.Dec()
+	e.RLock()
+	defer e.RUnlock()
+	e.collectPoolStats(ch)
 	for _, job := range e.jobs {
 		if job == nil {
 			continue
@@ -74,11 +255,88 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 			if query == nil {
 				continue
 			}
-			for _, metrics := range query.metrics {
+			// the runs replace the cached metrics in the meantime
+			query.Lock()
+			var count, bytes int
+			for conn, metrics := range query.metrics {
 				for _, metric := range metrics {
 					ch <- metric
+					count++
 				}
+				bytes += query.metricsBytes[conn]
+			}
+			query.Unlock()
+			ch <- prometheus.MustNewConstMetric(cachedMetricsDesc, prometheus.GaugeValue, float64(count), job.Name, query.Name)
+			ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(bytes), job.Name, query.Name)
+			if query.ExportInfo {
+				collectQueryInfo(ch, job, query)
 			}
+			if query.DebugRawValues {
+				collectRawValues(ch, job, query)
+			}
+		}
+	}
+}
+
+// collectQueryInfo exports the metadata of q, once for each driver of its
+// connections
+func collectQueryInfo(ch chan<- prometheus.Metric, job *Job, q *Query) {
+	interval := job.Interval
+	if q.SampleRate > 1 {
+		interval *= time.Duration(q.SampleRate)
+	}
+	intervalLabel := interval.String()
+	if q.RunMode == runModeOnce {
+		intervalLabel = runModeOnce
+	}
+	hash := queryHash(q.Query)
+	seen := make(map[string]bool)
+	for _, conn := range job.connections() {
+		if !q.selects(conn) || seen[conn.driver] {
+			continue
+		}
+		seen[conn.driver] = true
+		ch <- prometheus.MustNewConstMetric(queryInfoDesc, prometheus.GaugeValue, 1, job.Name, q.Name, hash, conn.driver, intervalLabel)
+	}
+}
+
+// metricBytes estimates the memory of a cached metric from its labels, which
+// make up most of it. Metrics which fail to write count the overhead only.
+func metricBytes(m prometheus.Metric) int {
+	bytes := metricOverheadBytes
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return bytes
+	}
+	for _, l := range pb.Label {
+		bytes += labelOverheadBytes + len(l.GetName()) + len(l.GetValue())
+	}
+	return bytes
+}
+
+// collectPoolStats exports the connection pool statistics of every open
+// handle of the jobs. They help to tell slow queries from waiting for a
+// connection. Handles shared by several connections are exported once, with
+// the labels of the connection which opened them. They are read from the
+// pool registry, since the jobs replace the handles of their connections
+// while connecting.
+func (e *Exporter) collectPoolStats(ch chan<- prometheus.Metric) {
+	// by name, the jobs of a reload take over the handles of the old ones
+	jobs := make(map[string]bool, len(e.jobs))
+	for _, job := range e.jobs {
+		if job != nil {
+			jobs[job.Name] = true
 		}
 	}
+	e.pools.each(func(p *pool) {
+		if !jobs[p.labels[0]] {
+			return
+		}
+		stats := p.db.Stats()
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), p.labels...)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), p.labels...)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), p.labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), p.labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), p.labels...)
+	})
 }
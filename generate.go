@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// starterQuery is an example query of a generated config
+type starterQuery struct {
+	name   string
+	help   string
+	format string
+	query  string
+}
+
+// starterQueries are the candidates for a generated config by driver. Only
+// the ones which return rows on the database end up in the config. Metric
+// columns are cast to text since all columns are exported as labels, see
+// updateMetric.
+var starterQueries = map[string][]starterQuery{
+	"postgres": {
+		{
+			name:  "pg_connections",
+			help:  "Number of connections by database and state",
+			query: "SELECT COALESCE(datname, '')::text AS datname, state::text AS state, COUNT(*)::text AS metric_count\nFROM pg_stat_activity\nWHERE state IS NOT NULL\nGROUP BY datname, state",
+		},
+		{
+			name:  "pg_database_size",
+			help:  "Size of each database in bytes",
+			query: "SELECT datname::text AS datname, pg_database_size(datname)::text AS metric_bytes\nFROM pg_database\nWHERE NOT datistemplate",
+		},
+		{
+			name:  "pg_table_rows",
+			help:  "Estimated number of live and dead rows of each user table",
+			query: "SELECT schemaname::text AS schemaname, relname::text AS relname, n_live_tup::text AS metric_live, n_dead_tup::text AS metric_dead\nFROM pg_stat_user_tables",
+		},
+		{
+			name:   "pg_replication_lag_seconds",
+			help:   "Seconds since the last replayed transaction, 0 on primaries",
+			format: formatSingle,
+			query:  "SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)",
+		},
+	},
+	"mysql": {
+		{
+			name:   "mysql_connections",
+			help:   "Number of client connections",
+			format: formatSingle,
+			query:  "SELECT COUNT(*) FROM information_schema.processlist",
+		},
+		{
+			name:  "mysql_table_size",
+			help:  "Estimated rows and data size in bytes of each user table",
+			query: "SELECT table_schema, table_name, CAST(COALESCE(table_rows, 0) AS CHAR) AS metric_rows, CAST(COALESCE(data_length, 0) AS CHAR) AS metric_data_bytes\nFROM information_schema.tables\nWHERE table_schema NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')",
+		},
+		{
+			name:   "mysql_variables",
+			help:   "Selected server variables",
+			format: formatInfo,
+			query:  "SHOW GLOBAL VARIABLES WHERE Variable_name IN ('version', 'max_connections', 'innodb_buffer_pool_size')",
+		},
+	},
+	"sqlserver": {
+		{
+			name:   "mssql_sessions",
+			help:   "Number of user sessions",
+			format: formatSingle,
+			query:  "SELECT COUNT(*) FROM sys.dm_exec_sessions WHERE is_user_process = 1",
+		},
+		{
+			name:  "mssql_database_size",
+			help:  "Size of each database in bytes",
+			query: "SELECT DB_NAME(database_id) AS name, CAST(SUM(CAST(size AS bigint)) * 8192 AS varchar(32)) AS metric_bytes\nFROM sys.master_files\nGROUP BY database_id",
+		},
+	},
+	"clickhouse": {
+		{
+			name:   "clickhouse_tables",
+			help:   "Number of tables",
+			format: formatSingle,
+			query:  "SELECT COUNT(*) FROM system.tables",
+		},
+	},
+}
+
+// fallbackQuery is used if none of the starter queries of a driver works
+var fallbackQuery = starterQuery{
+	name:   "up",
+	help:   "Always 1 if the database is reachable",
+	format: formatSingle,
+	query:  "SELECT 1",
+}
+
+// generate implements the generate command, which prints a starter config for
+// the database of the given DSN
+func generate(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	var (
+		dsn      = fs.String("dsn", "", "URL of the database to generate the config for, e.g. postgres://user@host/db.")
+		jobName  = fs.String("job", "example", "Name of the generated job.")
+		interval = fs.Duration("interval", time.Minute, "Interval of the generated job.")
+		timeout  = fs.Duration("timeout", 10*time.Second, "Timeout to connect and run each candidate query.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dsn == "" {
+		return fmt.Errorf("missing -dsn")
+	}
+	u, err := url.Parse(*dsn)
+	if err != nil {
+		return err
+	}
+	driver := u.Scheme
+	if driver == "postgresql" {
+		driver = "postgres"
+	}
+	candidates, found := starterQueries[driver]
+	if !found {
+		return fmt.Errorf("unsupported driver %s", u.Scheme)
+	}
+	db, err := connectTimeout(u.Scheme, driverDSN(u), *timeout)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// keep the queries which run on this database and return rows, e.g.
+	// pg_stat_user_tables is empty without user tables
+	queries := make([]starterQuery, 0, len(candidates))
+	for _, q := range candidates {
+		done := make(chan bool, 1)
+		go func(query string) {
+			rows, err := db.Query(query)
+			if err != nil {
+				done <- false
+				return
+			}
+			defer rows.Close()
+			done <- rows.Next()
+		}(q.query)
+		select {
+		case ok := <-done:
+			if ok {
+				queries = append(queries, q)
+			}
+		case <-time.After(*timeout):
+		}
+	}
+	if len(queries) == 0 {
+		queries = append(queries, fallbackQuery)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# generated by sql_exporter generate, see the README for all options\n")
+	fmt.Fprintf(&b, "jobs:\n")
+	fmt.Fprintf(&b, "- name: %q\n", *jobName)
+	fmt.Fprintf(&b, "  interval: %q\n", interval.String())
+	fmt.Fprintf(&b, "  connections:\n")
+	fmt.Fprintf(&b, "  - %q\n", *dsn)
+	fmt.Fprintf(&b, "  queries:\n")
+	for _, q := range queries {
+		fmt.Fprintf(&b, "  - name: %q\n", q.name)
+		fmt.Fprintf(&b, "    help: %q\n", q.help)
+		if q.format != "" {
+			fmt.Fprintf(&b, "    format: %q\n", q.format)
+		}
+		fmt.Fprintf(&b, "    query: |\n")
+		for _, line := range strings.Split(q.query, "\n") {
+			fmt.Fprintf(&b, "      %s\n", line)
+		}
+	}
+	_, err = io.WriteString(out, b.String())
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// resultHash is an order-independent hash of the rows of a result, see
+// Query.ResultHash. The row hashes are added up, so the rows may be returned
+// in any order while duplicate rows still count.
+type resultHash struct {
+	sum uint64
+}
+
+// add adds a scanned row to the hash
+func (r *resultHash) add(row map[string]interface{}) {
+	cols := make([]string, 0, len(row))
+	for col := range row {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	h := fnv.New64a()
+	for _, col := range cols {
+		v := row[col]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		fmt.Fprintf(h, "%s\x00%v\x00", col, v)
+	}
+	r.sum += h.Sum64()
+}
+
+// value returns the hash as a float. It's cut to 53 bits, so it's exact.
+func (r *resultHash) value() float64 {
+	return float64(r.sum & (1<<53 - 1))
+}
+
+// queryHash returns a stable hash of the text of a query, see Query.ExportInfo
+func queryHash(query string) string {
+	h := fnv.New64a()
+	h.Write([]byte(query))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -1,39 +1,209 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cenkalti/backoff"
-	_ "github.com/denisenkom/go-mssqldb" // register the MS-SQL driver
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	_ "github.com/go-sql-driver/mysql" // register the MySQL driver
 	"github.com/jmoiron/sqlx"
-	_ "github.com/kshvakov/clickhouse" // register the ClickHouse driver
-	_ "github.com/lib/pq"              // register the PostgreSQL driver
 	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
 )
 
+// runModeOnce is the Query.RunMode for queries on slowly-changing data, which
+// are run once per connection and cached forever
+const runModeOnce = "once"
+
+// values of Query.EmptyResult, which tells whether a query returning no rows
+// failed
+const (
+	emptyResultOK    = "ok"
+	emptyResultError = "error"
+)
+
+// formatSingle is the Query.Format for queries returning a single value, e.g.
+// SELECT COUNT(*), which is exported without the col label and doesn't need
+// the metric_ prefix
+const formatSingle = "single"
+
+// formatInfo is the Query.Format for queries returning text values, e.g. SHOW
+// VARIABLES. Every row is exported as an _info metric with the value 1 and all
+// columns as labels.
+const formatInfo = "info"
+
 var (
 	// MetricNameRE matches any invalid metric name
 	// characters, see github.com/prometheus/common/model.MetricNameRE
 	MetricNameRE = regexp.MustCompile("[^a-zA-Z0-9_:]+")
+	// LabelNameRE matches valid label names, see
+	// github.com/prometheus/common/model.LabelNameRE
+	LabelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	// unitRE matches valid metric units, e.g. seconds or bytes
+	unitRE = regexp.MustCompile("^[a-z][a-z0-9_]*$")
 )
 
 // Init will initialize the metric descriptors
 func (j *Job) Init(logger log.Logger, queries map[string]string) error {
 	j.log = log.With(logger, "job", j.Name)
+	j.stop = make(chan struct{})
+	// jobs outside of an exporter, e.g. of describe, get their own
+	if j.stats == nil {
+		j.stats = newExporterStats()
+	}
+	if j.pools == nil {
+		j.pools = newPoolRegistry()
+	}
+	if j.pauses == nil {
+		j.pauses = newPauseRegistry()
+	}
+	if j.Namespace != "" && !LabelNameRE.MatchString(j.Namespace) {
+		return fmt.Errorf("invalid namespace '%s'", j.Namespace)
+	}
+	if cb := j.CircuitBreaker; cb != nil && (cb.Failures < 1 || cb.Cooldown <= 0) {
+		return fmt.Errorf("circuit_breaker needs at least 1 failure and a cooldown")
+	}
+	if err := j.expandConnections(); err != nil {
+		return err
+	}
+	for i := range j.MaintenanceWindows {
+		if err := j.MaintenanceWindows[i].parse(); err != nil {
+			return err
+		}
+	}
+	if len(j.allowedStatements) > 0 {
+		for _, stmt := range j.StartupSQL {
+			if err := checkStatements(stmt, j.allowedStatements); err != nil {
+				return fmt.Errorf("startup_sql: %s", err)
+			}
+		}
+	}
+	// a missing driver fails the job instead of each connection attempt
+	for _, conn := range j.Connections {
+		for i := range conn.MaintenanceWindows {
+			if err := conn.MaintenanceWindows[i].parse(); err != nil {
+				return err
+			}
+		}
+		u, err := url.Parse(conn.URL)
+		if err != nil {
+			// reported when the connections are set up
+			continue
+		}
+		if conn.Route != "" {
+			if !validRoute(conn.Route, u.Scheme) {
+				return fmt.Errorf("route %s is not supported on %s", conn.Route, u.Scheme)
+			}
+			if len(conn.RouteHosts) == 0 || conn.Proxy != "" {
+				return fmt.Errorf("route %s needs route_hosts and no proxy", conn.Route)
+			}
+		}
+		if len(j.allowedStatements) > 0 {
+			for _, stmt := range conn.SetupQueries {
+				if err := checkStatements(stmt, j.allowedStatements); err != nil {
+					return fmt.Errorf("setup_queries: %s", err)
+				}
+			}
+			if conn.DatabasesQuery != "" {
+				if err := checkStatements(conn.DatabasesQuery, j.allowedStatements); err != nil {
+					return fmt.Errorf("databases_query: %s", err)
+				}
+			}
+		}
+		for _, pattern := range append(append([]string{}, conn.AllowQueries...), conn.DenyQueries...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid query pattern '%s'", pattern)
+			}
+		}
+		if conn.DatabasesQuery != "" && (conn.DatabaseLabel != "" || conn.Route != "") {
+			return fmt.Errorf("databases_query can't be combined with database_label or route")
+		}
+		if _, found := charsets[conn.Charset]; conn.Charset != "" && !found {
+			return fmt.Errorf("unknown charset '%s'", conn.Charset)
+		}
+		if conn.ConnectTimeout < 0 {
+			return fmt.Errorf("negative connect_timeout %s", conn.ConnectTimeout)
+		}
+		if conn.DatabasesInterval < 0 {
+			return fmt.Errorf("negative databases_interval %s", conn.DatabasesInterval)
+		}
+		if conn.Weight < 0 {
+			return fmt.Errorf("negative weight %d", conn.Weight)
+		}
+		if conn.KeepAliveInterval < 0 {
+			return fmt.Errorf("negative keepalive_interval %s", conn.KeepAliveInterval)
+		}
+		// the keepalive query is SQL
+		if conn.KeepAliveInterval > 0 && isSource(u.Scheme) {
+			return fmt.Errorf("keepalive_interval is not supported on %s", u.Scheme)
+		}
+		if err := checkDriver(u.Scheme); err != nil {
+			return err
+		}
+		if (j.ReadOnly || j.Snapshot) && !txDrivers[u.Scheme] {
+			return fmt.Errorf("read_only and snapshot are not supported on %s", u.Scheme)
+		}
+		if conn.Isolation != "" {
+			if _, found := isolationLevels[conn.Isolation]; !found {
+				return fmt.Errorf("unknown isolation level '%s'", conn.Isolation)
+			}
+			if !txDrivers[u.Scheme] {
+				return fmt.Errorf("isolation is not supported on %s", u.Scheme)
+			}
+		}
+	}
+	// every connection of a job needs the same label names, otherwise the
+	// metrics of the job would have inconsistent label dimensions
+	seen := make(map[string]struct{})
+	j.connLabels = nil
+	for _, conn := range j.Connections {
+		for name := range conn.Labels {
+			if _, found := seen[name]; found {
+				continue
+			}
+			if !LabelNameRE.MatchString(name) || reservedLabel(name) {
+				return fmt.Errorf("invalid connection label name '%s'", name)
+			}
+			seen[name] = struct{}{}
+			j.connLabels = append(j.connLabels, name)
+		}
+	}
+	sort.Strings(j.connLabels)
+	if err := j.expandQueries(queries); err != nil {
+		return err
+	}
+	// under a timeout the remaining queries are skipped, so the important
+	// ones have to run first
+	sort.SliceStable(j.Queries, func(a, b int) bool {
+		if j.Queries[a] == nil || j.Queries[b] == nil {
+			return j.Queries[b] == nil && j.Queries[a] != nil
+		}
+		return j.Queries[a].Priority > j.Queries[b].Priority
+	})
 	// register each query as an metric
+	metricNames := make(map[string]string)
 	for _, q := range j.Queries {
 		if q == nil {
 			level.Warn(j.log).Log("msg", "Skipping invalid query")
 			continue
 		}
 		q.log = log.With(j.log, "query", q.Name)
+		q.job = j.Name
+		q.namespace = j.Namespace
+		q.maxCardinality = j.maxCardinality
+		q.slots = j.slots
+		q.stats = j.stats
+		q.foldCardinality = j.foldCardinality
+		q.nameSanitizer = j.nameSanitizer
 		if q.Query == "" && q.QueryRef != "" {
 			if qry, found := queries[q.QueryRef]; found {
 				q.Query = qry
@@ -43,27 +213,165 @@ func (j *Job) Init(logger log.Logger, queries map[string]string) error {
 			level.Warn(q.log).Log("msg", "Skipping empty query")
 			continue
 		}
+		if len(j.allowedStatements) > 0 {
+			for _, stmt := range append([]string{q.Query}, q.SetupQueries...) {
+				if err := checkStatements(stmt, j.allowedStatements); err != nil {
+					return fmt.Errorf("query %s: %s", q.Name, err)
+				}
+			}
+		}
+		if len(q.SetupQueries) > 0 && j.Snapshot {
+			// the session is shared by all queries of the run
+			return fmt.Errorf("query %s: setup_queries can't be set per query with snapshot, set them on the connection", q.Name)
+		}
+		if !validAggregation(q.Aggregation) {
+			return fmt.Errorf("query %s: unknown aggregation '%s'", q.Name, q.Aggregation)
+		}
+		if err := j.checkIsolation(q); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if r := q.Reduce; r != nil && (r.Column == "" || !validReduce(r.Func)) {
+			return fmt.Errorf("query %s: reduce needs a column and one of sum, avg, max or min", q.Name)
+		}
+		for label, max := range q.LabelMaxLength {
+			if max <= utf8.RuneCountInString(q.TruncationSuffix) {
+				return fmt.Errorf("query %s: label_max_length of %s must be longer than the truncation_suffix", q.Name, label)
+			}
+		}
+		if q.MaxLabelLength > 0 && q.MaxLabelLength <= utf8.RuneCountInString(q.TruncationSuffix) {
+			return fmt.Errorf("query %s: max_label_length must be longer than the truncation_suffix", q.Name)
+		}
+		if q.RunMode != "" && q.RunMode != runModeOnce {
+			return fmt.Errorf("query %s: unknown run mode '%s'", q.Name, q.RunMode)
+		}
+		if q.EmptyResult != "" && q.EmptyResult != emptyResultOK && q.EmptyResult != emptyResultError {
+			return fmt.Errorf("query %s: unknown empty_result '%s'", q.Name, q.EmptyResult)
+		}
+		for name := range q.LabelDefaults {
+			if !LabelNameRE.MatchString(name) || reservedLabel(name) || strings.HasPrefix(name, "metric_") {
+				return fmt.Errorf("query %s: invalid label_defaults name '%s'", q.Name, name)
+			}
+		}
+		if q.SampleRate < 0 {
+			return fmt.Errorf("query %s: negative sample_rate %d", q.Name, q.SampleRate)
+		}
+		if q.ZeroRowsRetries < 0 {
+			return fmt.Errorf("query %s: negative zero_rows_retries %d", q.Name, q.ZeroRowsRetries)
+		}
+		if q.DeadlockRetries < 0 {
+			return fmt.Errorf("query %s: negative deadlock_retries %d", q.Name, q.DeadlockRetries)
+		}
+		if q.Format != "" && q.Format != formatSingle && q.Format != formatInfo {
+			return fmt.Errorf("query %s: unknown format '%s'", q.Name, q.Format)
+		}
+		if q.Streaming && (len(q.Params) > 0 || len(q.loopParams) > 0) {
+			return fmt.Errorf("query %s: streaming queries can't have params", q.Name)
+		}
+		for name := range q.Params {
+			if !LabelNameRE.MatchString(name) {
+				return fmt.Errorf("query %s: invalid param name '%s'", q.Name, name)
+			}
+		}
+		if q.Cumulative && q.Format == formatInfo {
+			return fmt.Errorf("query %s: format info can't be cumulative", q.Name)
+		}
+		if q.Delta && q.Format == formatInfo {
+			return fmt.Errorf("query %s: format info can't have deltas", q.Name)
+		}
+		if q.CreatedColumn != "" && (!q.Cumulative || q.Aggregation != "") {
+			return fmt.Errorf("query %s: created_column needs cumulative and no aggregation", q.Name)
+		}
+		if !validNegativeCounters(q.NegativeCounters) {
+			return fmt.Errorf("query %s: unknown negative_counters '%s'", q.Name, q.NegativeCounters)
+		}
+		if q.NegativeCounters != "" && !q.Cumulative {
+			return fmt.Errorf("query %s: negative_counters needs cumulative", q.Name)
+		}
+		if q.Cumulative && q.Untyped {
+			return fmt.Errorf("query %s: cumulative queries can't be untyped", q.Name)
+		}
+		if q.Format != "" && q.NameRegex != "" {
+			return fmt.Errorf("query %s: format %s can't be combined with name_regex", q.Name, q.Format)
+		}
+		for _, col := range q.CountColumns {
+			if q.Format != "" || !strings.HasPrefix(col, "metric_") {
+				return fmt.Errorf("query %s: invalid count_columns entry '%s', only metric_ columns can be counted", q.Name, col)
+			}
+		}
+		if !validDuplicateColumns(q.DuplicateColumns) {
+			return fmt.Errorf("query %s: unknown duplicate_columns '%s'", q.Name, q.DuplicateColumns)
+		}
+		if (q.NullLabel != nil && !utf8.ValidString(*q.NullLabel)) || !utf8.ValidString(q.EmptyLabel) {
+			return fmt.Errorf("query %s: null_label and empty_label must be valid UTF-8", q.Name)
+		}
+		for i := range q.RelabelConfigs {
+			if err := q.RelabelConfigs[i].compile(); err != nil {
+				return fmt.Errorf("query %s: %s", q.Name, err)
+			}
+		}
+		if err := q.checkDistribute(); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if err := q.checkExpectedLabels(); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if err := q.checkJSONPaths(); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if err := q.checkPositions(); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if t := q.NameTransform; t != nil {
+			if q.colLabel() == "" {
+				return fmt.Errorf("query %s: name_transform needs the col label", q.Name)
+			}
+			if err := t.compile(); err != nil {
+				return fmt.Errorf("query %s: %s", q.Name, err)
+			}
+		}
+		if col := q.colLabel(); col != "" && col != defaultColLabel {
+			if !LabelNameRE.MatchString(col) || reservedLabel(col) {
+				return fmt.Errorf("query %s: invalid col_label '%s'", q.Name, col)
+			}
+		}
+		metricName := q.metricName()
+		if !validMetricNameRE.MatchString(metricName) {
+			return fmt.Errorf("query %s: invalid metric name '%s'", q.Name, metricName)
+		}
+		// e.g. a sanitizer which maps distinct names to the same one
+		if other, found := metricNames[metricName]; found && other != q.Name {
+			level.Warn(q.log).Log("msg", "Queries share a metric name", "metric", metricName, "other", other)
+		}
+		metricNames[metricName] = q.Name
+		if q.Unit != "" {
+			if !unitRE.MatchString(q.Unit) {
+				return fmt.Errorf("query %s: invalid unit '%s'", q.Name, q.Unit)
+			}
+			// OpenMetrics requires the unit as the suffix of the name
+			if !strings.HasSuffix(q.metricName(), "_"+q.Unit) {
+				return fmt.Errorf("query %s: metric name %s doesn't end with the unit _%s", q.Name, q.metricName(), q.Unit)
+			}
+		}
+		if err := q.initNameRegex(); err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		if !j.anySelected(q) {
+			level.Warn(q.log).Log("msg", "Connection selector matches no connection", "selector", fmt.Sprint(q.ConnectionSelector))
+		}
 		if q.metrics == nil {
 			// we have no way of knowing how many metrics will be returned by the
 			// queries, so we just assume that each query returns at least one metric.
 			// after the each round of collection this will be resized as necessary.
 			q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
 		}
-		// try to satisfy prometheus naming restrictions
-		name := MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
-		help := q.Help
 		// prepare a new metrics descriptor
 		//
 		// the tricky part here is that the *order* of labels has to match the
 		// order of label values supplied to NewConstMetric later
-		q.desc = prometheus.NewDesc(
-			name,
-			help,
-			append(q.Labels, "driver", "host", "database", "user", "col"),
-			prometheus.Labels{
-				"sql_job": j.Name,
-			},
-		)
+		q.setDesc(q.labelNames(j.connLabels, nil))
+		if q.Reduce != nil {
+			q.reduceDesc = q.newReduceDesc(j.connLabels)
+		}
 	}
 	return nil
 }
@@ -78,35 +386,10 @@ func (j *Job) Run() {
 		level.Error(j.log).Log("msg", "No conenctions for job", "job", j.Name)
 		return
 	}
-	// make space for the connection objects
-	if j.conns == nil {
-		j.conns = make([]*connection, 0, len(j.Connections))
-	}
-	// parse the connection URLs and create an connection object for each
-	if len(j.conns) < len(j.Connections) {
-		for _, conn := range j.Connections {
-			u, err := url.Parse(conn)
-			if err != nil {
-				level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
-				continue
-			}
-			user := ""
-			if u.User != nil {
-				user = u.User.Username()
-			}
-			// we expose some of the connection variables as labels, so we need to
-			// remember them
-			j.conns = append(j.conns, &connection{
-				conn:     nil,
-				url:      u,
-				driver:   u.Scheme,
-				host:     u.Host,
-				database: strings.TrimPrefix(u.Path, "/"),
-				user:     user,
-			})
-		}
-	}
+	j.initConns()
 	level.Debug(j.log).Log("msg", "Starting")
+	keepAlive, stopKeepAlive := j.keepAliveTicker()
+	defer func() { stopKeepAlive() }()
 
 	// enter the run loop
 	// tries to run each query on each connection at approx the interval
@@ -116,49 +399,523 @@ func (j *Job) Run() {
 		if err := backoff.Retry(j.runOnce, bo); err != nil {
 			level.Error(j.log).Log("msg", "Failed to run", "err", err)
 		}
+		if len(j.discovery) > 0 {
+			// discovery may have added connections with a keep-alive
+			stopKeepAlive()
+			keepAlive, stopKeepAlive = j.keepAliveTicker()
+		}
 		level.Debug(j.log).Log("msg", "Sleeping until next run", "sleep", j.Interval.String())
-		time.Sleep(j.Interval)
+		next := time.After(j.Interval)
+	wait:
+		for {
+			select {
+			case <-j.stop:
+				level.Debug(j.log).Log("msg", "Stopping")
+				j.closeConns()
+				return
+			case <-keepAlive:
+				j.keepAlive()
+			case <-next:
+				break wait
+			}
+		}
 	}
 }
 
-func (j *Job) runOnceConnection(conn *connection, done chan int) {
-	updated := 0
+// Stop makes Run return after the current run and close the connections
+func (j *Job) Stop() {
+	close(j.stop)
+}
+
+// closeConns releases the database handles of all connections
+func (j *Job) closeConns() {
+	for _, conn := range j.conns {
+		conn.close()
+	}
+}
+
+// expandConnections replaces every connection template with one connection
+// per host. The expanded connections share the labels of the template.
+func (j *Job) expandConnections() error {
+	conns := make([]Connection, 0, len(j.Connections))
+	for _, conn := range j.Connections {
+		if conn.Template == "" {
+			conns = append(conns, conn)
+			continue
+		}
+		if conn.URL != "" {
+			return fmt.Errorf("connection has both an url and a template")
+		}
+		if !strings.Contains(conn.Template, "{host}") {
+			return fmt.Errorf("connection template %s has no {host} placeholder", conn.Template)
+		}
+		if len(conn.Hosts) == 0 {
+			return fmt.Errorf("connection template %s has no hosts", conn.Template)
+		}
+		if conn.Route != "" {
+			return fmt.Errorf("connection template %s can't have a route, use route_hosts instead", conn.Template)
+		}
+		if conn.HostLabel != "" {
+			// the metrics of the hosts would collide
+			return fmt.Errorf("connection template %s can't have a host_label", conn.Template)
+		}
+		for _, host := range conn.Hosts {
+			c := conn
+			c.URL = strings.Replace(conn.Template, "{host}", host, -1)
+			c.Template = ""
+			c.Hosts = nil
+			conns = append(conns, c)
+		}
+	}
+	j.Connections = conns
+	return nil
+}
+
+// expandQueries replaces every query with a loop with one query per item of
+// the loop. The items are added as a label, so the expanded queries share
+// the metric name.
+func (j *Job) expandQueries(queries map[string]string) error {
+	expanded := make([]*Query, 0, len(j.Queries))
+	for _, q := range j.Queries {
+		if q == nil || q.Loop == nil {
+			expanded = append(expanded, q)
+			continue
+		}
+		label := q.Loop.Label
+		if !LabelNameRE.MatchString(label) || reservedLabel(label) || strings.HasPrefix(label, "metric_") {
+			return fmt.Errorf("query %s: invalid loop label '%s'", q.Name, label)
+		}
+		if len(q.Loop.Items) == 0 {
+			return fmt.Errorf("query %s: loop has no items", q.Name)
+		}
+		query := q.Query
+		if query == "" {
+			query = queries[q.QueryRef]
+		}
+		tmpl, err := parseQueryTemplate(q.Name, query)
+		if err != nil {
+			return fmt.Errorf("query %s: %s", q.Name, err)
+		}
+		// the config is copied through YAML since a Query can't be copied
+		buf, err := yaml.Marshal(q)
+		if err != nil {
+			return err
+		}
+		for _, item := range q.Loop.Items {
+			query, params, err := executeQueryTemplate(tmpl, item)
+			if err != nil {
+				return fmt.Errorf("query %s: item %s: %s", q.Name, item, err)
+			}
+			e := &Query{}
+			if err := yaml.Unmarshal(buf, e); err != nil {
+				return err
+			}
+			e.Loop = nil
+			e.Query = query
+			e.loopParams = params
+			e.constLabels = map[string]string{label: item}
+			expanded = append(expanded, e)
+		}
+	}
+	j.Queries = expanded
+	return nil
+}
+
+// checkIsolation checks the isolation level of q, which needs a driver which
+// supports it on every connection the query runs on
+func (j *Job) checkIsolation(q *Query) error {
+	if q.Isolation == "" {
+		return nil
+	}
+	if _, found := isolationLevels[q.Isolation]; !found {
+		return fmt.Errorf("unknown isolation level '%s'", q.Isolation)
+	}
+	if j.Snapshot {
+		return fmt.Errorf("isolation can't be set per query with snapshot, set it on the connection")
+	}
+	for _, conn := range j.Connections {
+		selected := true
+		for name, value := range q.ConnectionSelector {
+			if conn.Labels[name] != value {
+				selected = false
+			}
+		}
+		u, err := url.Parse(conn.URL)
+		if err == nil && selected && !txDrivers[u.Scheme] {
+			return fmt.Errorf("isolation is not supported on %s", u.Scheme)
+		}
+	}
+	return nil
+}
+
+// anySelected reports whether the query runs on any connection of the job
+func (j *Job) anySelected(q *Query) bool {
+	for _, conn := range j.Connections {
+		matches := true
+		for name, value := range q.ConnectionSelector {
+			if conn.Labels[name] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// initConns parses the connection URLs and creates an connection object for
+// each. It does nothing if this already happened.
+func (j *Job) initConns() {
+	if j.conns != nil {
+		return
+	}
+	// make space for the connection objects
+	conns := make([]*connection, 0, len(j.Connections))
+	for _, conn := range j.Connections {
+		// the databases are discovered once the server is reachable, by
+		// the first run or check
+		if conn.DatabasesQuery != "" {
+			j.discovery = append(j.discovery, &discoverySource{conn: conn, databases: make(map[string]*connection)})
+			continue
+		}
+		if c := j.newConnection(conn); c != nil {
+			conns = append(conns, c)
+		}
+	}
+	j.setConnections(conns)
+}
+
+// setConnections replaces the connections of the job. The job itself reads
+// j.conns directly, everyone else uses connections.
+func (j *Job) setConnections(conns []*connection) {
+	j.connsLock.Lock()
+	defer j.connsLock.Unlock()
+	j.conns = conns
+}
+
+// connections returns the current connections of the job, e.g. for a scrape
+// while discovery replaces them
+func (j *Job) connections() []*connection {
+	j.connsLock.RLock()
+	defer j.connsLock.RUnlock()
+	return j.conns
+}
+
+// newConnection sets up the connection for conn, it's nil if conn is invalid
+func (j *Job) newConnection(conn Connection) *connection {
+	u, err := url.Parse(conn.URL)
+	if err != nil {
+		level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn.URL, "err", err)
+		return nil
+	}
+	if err := conn.withTLSFiles(u); err != nil {
+		level.Error(j.log).Log("msg", "Failed to configure TLS", "host", u.Host, "err", err)
+		return nil
+	}
+	var proxy *url.URL
+	if conn.Proxy != "" {
+		proxy, err = url.Parse(conn.Proxy)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse proxy URL", "host", u.Host, "err", err)
+			return nil
+		}
+	}
+	labels := make([]string, len(j.connLabels))
+	for i, name := range j.connLabels {
+		labels[i] = conn.Labels[name]
+	}
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	// the labels may show e.g. a tenant instead of a shared account
+	host, database := u.Host, strings.TrimPrefix(u.Path, "/")
+	if conn.HostLabel != "" {
+		host = conn.HostLabel
+	}
+	if conn.DatabaseLabel != "" {
+		database = conn.DatabaseLabel
+	}
+	if conn.UserLabel != "" {
+		user = conn.UserLabel
+	}
+	weight := conn.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	timeout := conn.ConnectTimeout
+	if timeout == 0 {
+		timeout = j.ConnectTimeout
+	}
+	// we expose some of the connection variables as labels, so we need to
+	// remember them
+	return &connection{
+		conn:         nil,
+		url:          u,
+		proxy:        proxy,
+		driver:       u.Scheme,
+		host:         host,
+		database:     database,
+		user:         user,
+		labelNames:   j.connLabels,
+		labelValues:  labels,
+		readOnly:     j.ReadOnly || j.Snapshot,
+		keepAlive:    conn.KeepAliveInterval,
+		route:        conn.Route,
+		routeHosts:   conn.RouteHosts,
+		fixedHost:    conn.HostLabel != "",
+		isolation:    conn.Isolation,
+		windows:      append(append([]MaintenanceWindow{}, j.MaintenanceWindows...), conn.MaintenanceWindows...),
+		allowQueries: conn.AllowQueries,
+		denyQueries:  conn.DenyQueries,
+		setup:        conn.SetupQueries,
+		weight:       weight,
+		charset:      charsets[conn.Charset],
+		timeout:      timeout,
+		interval:     j.Interval,
+		pools:        j.pools,
+	}
+}
+
+// descCollector is a collector for a single descriptor that collects nothing.
+// It's used to check if a descriptor can be registered.
+type descCollector struct {
+	desc *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (c descCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c descCollector) Collect(ch chan<- prometheus.Metric) {}
+
+// Check sets up the descriptor of each query on the first reachable
+// connection it runs on and registers them with reg. This detects invalid or
+// conflicting descriptors on startup instead of on the first scrape.
+// Connections which can't be reached and queries which fail to run are
+// skipped with a warning.
+func (j *Job) Check(reg *prometheus.Registry) error {
+	if j.log == nil {
+		j.log = log.NewNopLogger()
+	}
+	j.initConns()
+	// a slow database must not block the startup, so the check is bounded by
+	// the timeout of the job or, if there is none, its interval
+	timeout := j.Timeout
+	if timeout <= 0 {
+		timeout = j.Interval
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	j.discoverDatabases(ctx)
+	for _, q := range j.Queries {
+		if q == nil || q.Query == "" {
+			continue
+		}
+		for _, conn := range j.conns {
+			if !q.selects(conn) {
+				continue
+			}
+			// connect fails fast for connections which already failed before
+			if err := conn.connect(j); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to connect, skipping check", "err", err, "host", conn.host, "db", conn.database)
+				continue
+			}
+			if err := q.SetDesc(ctx, conn); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to set descriptor, skipping check", "err", err)
+				break
+			}
+			if err := reg.Register(descCollector{q.getDesc()}); err != nil {
+				// queries of different jobs only conflict without a namespace
+				return fmt.Errorf("query %s: %s (set a namespace if another job defines the same query)", q.Name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (j *Job) runOnceConnection(ctx context.Context, conn *connection, done chan int) {
+	// updated includes the cached queries, ran only the successful runs
+	updated, ran, failed := 0, 0, 0
 	defer func() {
 		done <- updated
 	}()
 
+	// the last results are served until the pause is over
+	if j.paused(conn) {
+		level.Debug(j.log).Log("msg", "Skipping connection. Paused", "host", conn.host, "db", conn.database)
+		j.stats.connectionPaused.WithLabelValues(j.Name, conn.host, conn.database).Set(1)
+		for _, q := range j.Queries {
+			if q != nil && q.runsOn(conn) {
+				updated++
+			}
+		}
+		return
+	}
+	j.stats.connectionPaused.WithLabelValues(j.Name, conn.host, conn.database).Set(0)
+	if j.circuitOpen(conn) {
+		level.Debug(j.log).Log("msg", "Skipping connection. Circuit open", "until", conn.circuitUntil.Format(time.RFC3339), "host", conn.host, "db", conn.database)
+		j.connectionDown(conn)
+		return
+	}
 	// connect to DB if not connected already
+	// the connection stays down and is retried on the next run
 	if err := conn.connect(j); err != nil {
-		level.Warn(j.log).Log("msg", "Failed to connect", "err", err)
+		level.Warn(j.log).Log("msg", "Failed to connect", "err", err, "host", conn.host, "db", conn.database)
+		j.stats.connectionUp.WithLabelValues(j.Name, conn.host, conn.database).Set(0)
+		j.connectionDown(conn)
+		j.recordRun(conn, false)
 		return
 	}
+	j.stats.connectionUp.WithLabelValues(j.Name, conn.host, conn.database).Set(1)
+	if j.Snapshot {
+		if err := conn.beginSnapshot(ctx); err != nil {
+			// the queries still run, each in a transaction of its own
+			level.Warn(j.log).Log("msg", "Failed to begin snapshot", "err", err, "host", conn.host, "db", conn.database)
+		}
+		defer conn.endSnapshot()
+	}
 
 	for _, q := range j.Queries {
 		if q == nil {
 			continue
 		}
-		q.SetDesc(conn, j.Name)
+		if !q.runsOn(conn) {
+			continue
+		}
+		// static queries serve their first result forever
+		if q.RunMode == runModeOnce && q.hasRun(conn) {
+			j.stats.queryCacheHits.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Inc()
+			updated++
+			continue
+		}
+		// sampled queries serve their cached metrics in between
+		if !q.sampled(conn) {
+			j.stats.queryCacheHits.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Inc()
+			updated++
+			continue
+		}
+		// the remaining queries keep serving their cached metrics
+		if ctx.Err() != nil {
+			level.Warn(q.log).Log("msg", "Skipping query. Job timeout exceeded", "host", conn.host, "db", conn.database)
+			continue
+		}
+		// on failure, e.g. a timeout, the descriptor is set up on the next run
+		if err := q.SetDesc(ctx, conn); err != nil {
+			level.Warn(q.log).Log("msg", "Skipping query. Failed to set descriptor", "err", err, "host", conn.host, "db", conn.database)
+			j.stats.queryUp.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Set(0)
+			j.restartSnapshot(ctx, conn)
+			failed++
+			continue
+		}
 		if q.desc == nil {
 			level.Warn(q.log).Log("msg", "Skipping query. Collector is nil")
 			continue
 		}
 		level.Debug(q.log).Log("msg", "Running Query")
 		// execute the query on the connection
-		if err := q.Run(conn); err != nil {
+		j.stats.queryCacheMisses.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Inc()
+		j.stats.connectionQueries.WithLabelValues(j.Name, conn.host, conn.database).Inc()
+		atomic.AddInt64(&j.executed, 1)
+		if err := q.Run(ctx, conn); err != nil {
 			level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+			j.stats.queryUp.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Set(0)
+			j.restartSnapshot(ctx, conn)
+			failed++
 			continue
 		}
+		j.stats.queryUp.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Set(1)
 		level.Debug(q.log).Log("msg", "Query finished")
+		if q.Distribute != "" {
+			q.dropOtherPicks(conn)
+		}
+		if q.TrackPlan {
+			if err := q.checkPlan(ctx, conn); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to explain query", "err", err, "host", conn.host, "db", conn.database)
+			}
+		}
 		updated++
+		ran++
+	}
+	if ran > 0 {
+		j.stats.connectionLastRun.WithLabelValues(j.Name, conn.host, conn.database).SetToCurrentTime()
+	}
+	// runs of cached queries only don't tell anything about the database
+	if ran > 0 || failed > 0 {
+		j.recordRun(conn, ran > 0)
+	}
+}
+
+// connectionDown marks the queries of conn as down
+func (j *Job) connectionDown(conn *connection) {
+	for _, q := range j.Queries {
+		if q != nil && q.runsOn(conn) {
+			j.stats.queryUp.WithLabelValues(j.Name, q.Name, conn.host, conn.database).Set(0)
+		}
+	}
+}
+
+// restartSnapshot begins a new snapshot after a failed query, since an
+// error aborts the transaction on PostgreSQL
+func (j *Job) restartSnapshot(ctx context.Context, conn *connection) {
+	if conn.tx == nil {
+		return
+	}
+	conn.endSnapshot()
+	if ctx.Err() != nil {
+		// the remaining queries are skipped anyway
+		return
+	}
+	if err := conn.beginSnapshot(ctx); err != nil {
+		level.Warn(j.log).Log("msg", "Failed to begin snapshot", "err", err, "host", conn.host, "db", conn.database)
 	}
 }
 
 func (j *Job) runOnce() error {
+	// all connections share the time budget of the job, discovery included
+	ctx := context.Background()
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	if len(j.discovery) > 0 {
+		j.discoverDatabases(ctx)
+	}
 	doneChan := make(chan int, len(j.conns))
 
+	// the load on the databases if every query runs, cached and skipped
+	// queries don't
+	j.distribute()
+	estimated := 0
+	for _, conn := range j.conns {
+		for _, q := range j.Queries {
+			if q != nil && q.runsOn(conn) {
+				estimated++
+			}
+		}
+	}
+	j.stats.estimatedQueries.WithLabelValues(j.Name).Set(float64(estimated))
+	// the cardinality limit applies to each run
+	for _, q := range j.Queries {
+		if q != nil {
+			q.resetCardinality()
+		}
+	}
+	atomic.StoreInt64(&j.executed, 0)
+
 	// execute queries for each connection in parallel
 	for _, conn := range j.conns {
-		go j.runOnceConnection(conn, doneChan)
+		go j.runOnceConnection(ctx, conn, doneChan)
 	}
 
 	// connections now run in parallel, wait for and collect results
@@ -166,6 +923,14 @@ func (j *Job) runOnce() error {
 	for range j.conns {
 		updated += <-doneChan
 	}
+	j.stats.executedQueries.WithLabelValues(j.Name).Set(float64(atomic.LoadInt64(&j.executed)))
+
+	if ctx.Err() == context.DeadlineExceeded {
+		level.Warn(j.log).Log("msg", "Job timeout exceeded", "timeout", j.Timeout.String())
+		j.stats.scrapeTimedOut.WithLabelValues(j.Name).Set(1)
+	} else {
+		j.stats.scrapeTimedOut.WithLabelValues(j.Name).Set(0)
+	}
 
 	if updated < 1 {
 		return fmt.Errorf("zero queries ran")
@@ -173,34 +938,181 @@ func (j *Job) runOnce() error {
 	return nil
 }
 
+// connect makes sure the connection has a live database handle. An existing
+// handle is pinged and replaced if it broke, e.g. after a database restart.
+// Failed attempts are retried with an exponential backoff, until then connect
+// fails fast without touching the database.
 func (c *connection) connect(job *Job) error {
-	// already connected
 	if c.conn != nil {
-		return nil
+		err := c.conn.Ping()
+		if err == nil {
+			return nil
+		}
+		level.Warn(job.log).Log("msg", "Connection lost, reconnecting", "err", err, "host", c.host, "db", c.database)
+		// the other connections sharing the handle will notice on their own
+		c.pools.invalidate(c.pool)
+		c.close()
+	}
+	if c.backoff == nil {
+		c.backoff = backoff.NewExponentialBackOff()
+		// never give up, a database may be down for a long time
+		c.backoff.MaxElapsedTime = 0
+	}
+	if time.Now().Before(c.retryAt) {
+		return fmt.Errorf("connection down, next attempt at %s", c.retryAt.Format(time.RFC3339))
 	}
-	dsn := c.url.String()
-	switch c.url.Scheme {
+	if err := c.open(job); err != nil {
+		c.setConnError(job, err)
+		c.retryAt = time.Now().Add(c.backoff.NextBackOff())
+		return err
+	}
+	c.setConnError(job, nil)
+	c.backoff.Reset()
+	c.retryAt = time.Time{}
+	return nil
+}
+
+// open gets a database handle for the connection. Connections with the same
+// DSN and startup SQL share a single handle, see poolRegistry.
+func (c *connection) open(job *Job) error {
+	// the host is chosen again on every reconnect, e.g. after a failover
+	if c.route != "" {
+		routed, host, err := c.routedURL(job)
+		if err != nil {
+			return err
+		}
+		c.url = routed
+		if !c.fixedHost {
+			c.handleLock.Lock()
+			c.host = host
+			c.handleLock.Unlock()
+		}
+	}
+	u := c.url
+	// the driver connects to a local port which is forwarded to the database
+	if c.proxy != nil {
+		if c.forward == nil {
+			target, err := proxyTarget(c.url)
+			if err != nil {
+				return err
+			}
+			f, err := newForwarder(job.log, c.proxy, target)
+			if err != nil {
+				return err
+			}
+			c.forward = f
+		}
+		u = proxiedURL(c.url, c.forward.addr())
+	}
+	dsn := driverDSN(u)
+	key := strings.Join(append([]string{c.url.Scheme, dsn}, job.StartupSQL...), "\x00")
+	labels := []string{job.Name, c.driver, c.host, c.database, c.user}
+	p, err := c.pools.get(key, labels, c.interval, func() (*sqlx.DB, error) {
+		return openDB(job, c.url.Scheme, dsn, c.timeout)
+	})
+	if err != nil {
+		return err
+	}
+	c.handleLock.Lock()
+	defer c.handleLock.Unlock()
+	c.pool = p
+	c.conn = p.db
+	return nil
+}
+
+// driverDSN converts a connection URL into the DSN format of its driver. The
+// MySQL driver expects user:password@tcp(host:port)/database, which isn't a
+// valid URL, so it's built from the parts of the URL. That way a route or a
+// proxy only needs to replace the host of the URL.
+func driverDSN(u *url.URL) string {
+	dsn := u.String()
+	switch u.Scheme {
 	case "mysql":
-		dsn = strings.Replace(dsn, "%40", "@", -1)
-		dsn = strings.TrimPrefix(dsn, "mysql://")
+		dsn = "tcp(" + u.Host + ")/" + strings.TrimPrefix(u.Path, "/")
+		if u.RawQuery != "" {
+			dsn += "?" + u.RawQuery
+		}
+		if u.User != nil {
+			user := u.User.Username()
+			if password, ok := u.User.Password(); ok {
+				user += ":" + password
+			}
+			dsn = user + "@" + dsn
+		}
 	case "clickhouse":
 		dsn = "tcp://" + strings.TrimPrefix(dsn, "clickhouse://")
 	}
-	conn, err := sqlx.Connect(c.url.Scheme, dsn)
+	return dsn
+}
+
+// close releases the database handle of the connection
+func (c *connection) close() {
+	if c.pool != nil {
+		c.pools.release(c.pool, c.interval)
+	}
+	c.handleLock.Lock()
+	c.pool = nil
+	c.conn = nil
+	c.handleLock.Unlock()
+	if c.forward != nil {
+		c.forward.close()
+		c.forward = nil
+	}
+}
+
+// openDB creates a new database handle within timeout and runs the startup
+// SQL on it
+func openDB(job *Job, driver, dsn string, timeout time.Duration) (*sqlx.DB, error) {
+	conn, err := connectTimeout(driver, dsn, timeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// be nice and don't use up too many connections for mere metrics
+	// be nice and don't use up too many connections for mere metrics, the
+	// limit grows with the connections sharing the handle and the lifetime
+	// follows their jobs, see pool.resize
 	conn.SetMaxOpenConns(1)
 	conn.SetMaxIdleConns(1)
 	conn.SetConnMaxLifetime(job.Interval * 2)
 
-	// execute StartupSQL
+	// execute StartupSQL, a failure is retried with the backoff of the
+	// connection like any other connect error
 	for _, query := range job.StartupSQL {
 		level.Debug(job.log).Log("msg", "StartupSQL", "Query:", query)
-		conn.MustExec(query)
+		if _, err := conn.Exec(query); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("startup_sql failed: %s", err)
+		}
 	}
+	return conn, nil
+}
 
-	c.conn = conn
-	return nil
+// connectTimeout opens and pings a new database handle, giving up after
+// timeout. Not all drivers honor a context, so the attempt is raced against a
+// timer instead. A zero timeout waits indefinitely.
+func connectTimeout(driver, dsn string, timeout time.Duration) (*sqlx.DB, error) {
+	if timeout <= 0 {
+		return sqlx.Connect(driver, dsn)
+	}
+	type result struct {
+		conn *sqlx.DB
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := sqlx.Connect(driver, dsn)
+		done <- result{conn, err}
+	}()
+	select {
+	case res := <-done:
+		return res.conn, res.err
+	case <-time.After(timeout):
+		// don't leak the handle if the attempt succeeds after all
+		go func() {
+			if res := <-done; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		// classified as a timeout, see classifyConnError
+		return nil, fmt.Errorf("connect timed out after %s: %w", timeout, context.DeadlineExceeded)
+	}
 }
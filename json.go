@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonValue converts a JSON value to a column value
+func jsonValue(v interface{}) driver.Value {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case json.Number:
+		return t.String()
+	case string:
+		return t
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// checkJSONPaths validates the paths of Query.JSONPath on startup
+func (q *Query) checkJSONPaths() error {
+	for col, path := range q.JSONPath {
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return fmt.Errorf("invalid json_path '%s' of column %s", path, col)
+			}
+		}
+	}
+	return nil
+}
+
+// extractJSON replaces the values of the JSON columns of a row by the fields
+// selected by Query.JSONPath, so they are parsed like any other value or label
+// column. A field which doesn't exist becomes an empty string.
+func (q *Query) extractJSON(res map[string]interface{}) error {
+	for col, path := range q.JSONPath {
+		raw, ok := res[col]
+		if !ok || raw == nil {
+			continue
+		}
+		var doc []byte
+		switch t := raw.(type) {
+		case []uint8:
+			doc = t
+		case string:
+			doc = []byte(t)
+		default:
+			q.coercionError(col, raw)
+			return fmt.Errorf("Column '%s' must be JSON text, is '%T'", col, raw)
+		}
+		dec := json.NewDecoder(bytes.NewReader(doc))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			q.coercionError(col, raw)
+			return fmt.Errorf("Column '%s' must be JSON: %s", col, err)
+		}
+		res[col] = jsonValue(jsonField(v, path))
+	}
+	return nil
+}
+
+// jsonField returns the field of v at a dotted path, e.g. stats.reads, where
+// a number indexes an array, e.g. items.0.count. It returns nil if the field
+// doesn't exist.
+func jsonField(v interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
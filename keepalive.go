@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// keepAliveTicker returns a channel which ticks at the shortest keep-alive
+// interval of the connections of the job, or nil if none has one
+func (j *Job) keepAliveTicker() (<-chan time.Time, func()) {
+	var interval time.Duration
+	for _, conn := range j.conns {
+		if conn.keepAlive > 0 && (interval == 0 || conn.keepAlive < interval) {
+			interval = conn.keepAlive
+		}
+	}
+	if interval == 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
+
+// keepAlive pings the connected connections which are due, so idle
+// connections are not dropped by the database or a firewall in between runs.
+// It runs in between the runs of the job, so it doesn't race with them.
+func (j *Job) keepAlive() {
+	now := time.Now()
+	for _, conn := range j.conns {
+		if conn.keepAlive == 0 || conn.conn == nil || now.Before(conn.pingAt) || j.paused(conn) {
+			continue
+		}
+		conn.pingAt = now.Add(conn.keepAlive)
+		timeout := conn.timeout
+		if timeout == 0 {
+			timeout = conn.keepAlive
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var one int
+		err := conn.conn.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		cancel()
+		if err != nil {
+			// the next run reconnects
+			level.Warn(j.log).Log("msg", "Keep-alive ping failed", "err", err, "host", conn.host, "db", conn.database)
+			j.stats.connectionUp.WithLabelValues(j.Name, conn.host, conn.database).Set(0)
+			continue
+		}
+		j.stats.connectionUp.WithLabelValues(j.Name, conn.host, conn.database).Set(1)
+	}
+}
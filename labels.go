@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeLabel makes the value of a label from a column safe to export, if
+// enabled for the query. Invalid UTF-8 is replaced, control characters are
+// removed and the value is truncated, see truncateLabel.
+func (q *Query) sanitizeLabel(name, lv string) string {
+	if q.SanitizeLabels {
+		if !utf8.ValidString(lv) {
+			lv = strings.ToValidUTF8(lv, string(utf8.RuneError))
+		}
+		lv = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, lv)
+	}
+	return q.truncateLabel(name, lv)
+}
+
+// truncateLabel truncates the value of a label to LabelMaxLength of the label
+// or MaxLabelLength runes, including the TruncationSuffix. It never cuts a
+// multi-byte character in half.
+func (q *Query) truncateLabel(name, lv string) string {
+	max, found := q.LabelMaxLength[name]
+	if !found {
+		max = q.MaxLabelLength
+	}
+	if max <= 0 || utf8.RuneCountInString(lv) <= max {
+		return lv
+	}
+	suffix := q.TruncationSuffix
+	keep := max - utf8.RuneCountInString(suffix)
+	if keep < 0 {
+		// the suffix doesn't fit, see Job.Init
+		keep, suffix = max, ""
+	}
+	return string([]rune(lv)[:keep]) + suffix
+}
+
+// labelKey returns a map key of the given label values. 0xff is not valid
+// UTF-8, so it can't be part of any label value.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
@@ -4,26 +4,53 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/common/version"
 )
 
 func init() {
-	prometheus.MustRegister(version.NewCollector("sql_exporter"))
+	prometheus.MustRegister(versioncollector.NewCollector("sql_exporter"))
 }
 
 func main() {
+	// sql_exporter generate -dsn ... prints a starter config
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		if err := generate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error generating config:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// sql_exporter describe -query ... prints the metric name and labels
+	if len(os.Args) > 1 && os.Args[1] == "describe" {
+		if err := describe(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error describing query:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	var (
-		showVersion   = flag.Bool("version", false, "Print version information.")
-		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		configFile    = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
+		showVersion     = flag.Bool("version", false, "Print version information.")
+		listenAddress   = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
+		adminAddress    = flag.String("web.admin-listen-address", "", "Address to serve the admin endpoints /-/reload, /-/self-test, /-/pause, /probe and pprof on instead of web.listen-address.")
+		metricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		configFile      = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
+		configDir       = flag.String("config.dir", os.Getenv("CONFIG_DIR"), "Directory of SQL Exporter configuration files to merge. Overrides config.file.")
+		configOverlay   = flag.String("config.overlay", os.Getenv("CONFIG_OVERLAY"), "SQL Exporter configuration file patched into the configuration, e.g. for an environment.")
+		configCheck     = flag.Bool("config.check", false, "Verify the query descriptors against the databases on startup.")
+		enablePprof     = flag.Bool("web.enable-pprof", false, "Serve the pprof profiling endpoints under /debug/pprof/.")
+		durationBuckets = flag.String("query.duration-buckets", "", "Comma separated buckets of sql_query_duration_seconds, e.g. 0.01,0.1,1,10.")
+		rowsBuckets     = flag.String("query.rows-buckets", "", "Comma separated buckets of sql_query_rows, e.g. 1,10,100,1000.")
 	)
 
 	flag.Parse()
@@ -55,17 +82,74 @@ func main() {
 
 	logger.Log("msg", "Starting sql_exporter", "version_info", version.Info(), "build_context", version.BuildContext())
 
-	exporter, err := NewExporter(logger, *configFile)
+	if *durationBuckets != "" {
+		buckets, err := parseBuckets(*durationBuckets)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid query.duration-buckets", "err", err)
+			os.Exit(1)
+		}
+		setQueryDurationBuckets(buckets)
+	}
+	if *rowsBuckets != "" {
+		buckets, err := parseBuckets(*rowsBuckets)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid query.rows-buckets", "err", err)
+			os.Exit(1)
+		}
+		setQueryRowsBuckets(buckets)
+	}
+	exporter, err := NewExporter(logger, *configFile, *configDir, *configOverlay, *configCheck)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error starting exporter", "err", err)
 		os.Exit(1)
 	}
+	if err := exporter.stats.register(prometheus.DefaultRegisterer); err != nil {
+		level.Error(logger).Log("msg", "Error registering exporter metrics", "err", err)
+		os.Exit(1)
+	}
 	prometheus.MustRegister(exporter)
 
+	// reload the config on SIGHUP or a POST to /-/reload
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := exporter.Reload(); err != nil {
+				level.Error(logger).Log("msg", "Failed to reload config", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded config")
+		}
+	}()
+
 	// setup and start webserver
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// the pprof import registers its handlers on the default mux, so it must
+	// not be served
+	mux := http.NewServeMux()
+	// the admin endpoints may be served on a separate, restricted address
+	admin := mux
+	if *adminAddress != "" {
+		admin = http.NewServeMux()
+	}
+	mux.Handle(*metricsPath, metricsHandler(logger, prometheus.DefaultGatherer, exporter, exporter.stats.scrapeErrors))
+	admin.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := exporter.Reload(); err != nil {
+			level.Error(logger).Log("msg", "Failed to reload config", "err", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		level.Info(logger).Log("msg", "Reloaded config")
+	})
+	admin.Handle("/-/self-test", selfTestHandler(exporter))
+	admin.Handle("/-/pause", pauseHandler(exporter, false))
+	admin.Handle("/-/resume", pauseHandler(exporter, true))
+	admin.Handle("/probe", probeHandler(exporter))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 		<head><title>SQL Exporter</title></head>
 		<body>
@@ -76,8 +160,25 @@ func main() {
 		`))
 	})
 
+	if *enablePprof {
+		admin.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if *adminAddress != "" {
+		go func() {
+			level.Info(logger).Log("msg", "Listening for admin requests", "adminListenAddress", *adminAddress)
+			if err := http.ListenAndServe(*adminAddress, admin); err != nil {
+				level.Error(logger).Log("msg", "Error starting admin HTTP server:", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
 	level.Info(logger).Log("msg", "Listening", "listenAddress", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	if err := http.ListenAndServe(*listenAddress, mux); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server:", "err", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exporterStats are the metrics about the exporter itself, as opposed to the
+// metrics exported from the queries. Every Exporter has its own, so several
+// exporters in a process, see NewCollector, don't share them.
+type exporterStats struct {
+	queryLastSuccess         *prometheus.GaugeVec
+	queryDuration            *prometheus.HistogramVec
+	queryRows                *prometheus.HistogramVec
+	queryUp                  *prometheus.GaugeVec
+	connectionQueries        *prometheus.CounterVec
+	connectionUp             *prometheus.GaugeVec
+	connectionError          *prometheus.GaugeVec
+	connectionLastRun        *prometheus.GaugeVec
+	circuitOpen              *prometheus.GaugeVec
+	connectionPaused         *prometheus.GaugeVec
+	querySeries              *prometheus.GaugeVec
+	resultHashes             *prometheus.GaugeVec
+	scrapeTimedOut           *prometheus.GaugeVec
+	estimatedQueries         *prometheus.GaugeVec
+	executedQueries          *prometheus.GaugeVec
+	schemaChanges            *prometheus.CounterVec
+	planChanges              *prometheus.CounterVec
+	queryCacheHits           *prometheus.CounterVec
+	queryCacheMisses         *prometheus.CounterVec
+	deadlockRetries          *prometheus.CounterVec
+	valueCoercionErrors      *prometheus.CounterVec
+	negativeCounterValues    *prometheus.CounterVec
+	activeScrapes            prometheus.Gauge
+	activeQueries            *prometheus.GaugeVec
+	scrapeErrors             prometheus.Counter
+	queriesWaiting           prometheus.Gauge
+	labelCardinalityExceeded *prometheus.GaugeVec
+	configReloads            *prometheus.CounterVec
+	configLastReloadSuccess  prometheus.Gauge
+}
+
+// newExporterStats returns new, unregistered metrics about the exporter
+func newExporterStats() *exporterStats {
+	return &exporterStats{
+		queryLastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_query_last_success_timestamp",
+				Help: "Unix timestamp of the last successful run of a query on a connection.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		queryDuration: newQueryDuration(queryDurationBuckets),
+		queryRows:     newQueryRows(queryRowsBuckets),
+		queryUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_query_up",
+				Help: "Whether the last run of a query on a connection succeeded.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		connectionQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_connection_queries_total",
+				Help: "Total number of queries run on a connection.",
+			},
+			[]string{"sql_job", "host", "database"},
+		),
+		connectionUp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_connection_up",
+				Help: "Whether the last connect or keep-alive ping of a connection succeeded.",
+			},
+			[]string{"sql_job", "host", "database"},
+		),
+		connectionError: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_connection_error",
+				Help: "Whether the last connect of a connection failed for the reason: auth, network, dns, tls, timeout or other.",
+			},
+			[]string{"sql_job", "host", "database", "reason"},
+		),
+		connectionLastRun: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_connection_last_run_timestamp",
+				Help: "Unix timestamp of the last run of a job on a connection with at least one successful query.",
+			},
+			[]string{"sql_job", "host", "database"},
+		),
+		circuitOpen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_connection_circuit_open",
+				Help: "Whether the circuit breaker of a connection is open and its queries are skipped.",
+			},
+			[]string{"sql_job", "host", "database"},
+		),
+		connectionPaused: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_paused",
+				Help: "Whether the queries of a connection are paused by /-/pause or a maintenance window.",
+			},
+			[]string{"sql_job", "host", "database"},
+		),
+		querySeries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_query_series_count",
+				Help: "Number of series exported by the last successful run of a query on a connection.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		resultHashes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_query_result_hash",
+				Help: "Hash of the last result of a query on a connection, changes when any of the data changes.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		scrapeTimedOut: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_scrape_timed_out",
+				Help: "Whether the last run of a job exceeded its timeout and skipped queries.",
+			},
+			[]string{"sql_job"},
+		),
+		estimatedQueries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_estimated_db_queries_per_scrape",
+				Help: "Number of queries a run of a job sends to the databases if every query runs.",
+			},
+			[]string{"sql_job"},
+		),
+		executedQueries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_db_queries_per_scrape",
+				Help: "Number of queries the last run of a job sent to the databases.",
+			},
+			[]string{"sql_job"},
+		),
+		schemaChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_query_schema_change_total",
+				Help: "Total number of times the columns of a query changed and its descriptor was rebuilt.",
+			},
+			[]string{"sql_job", "query"},
+		),
+		planChanges: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_query_plan_changes_total",
+				Help: "Total number of times the PostgreSQL plan of a query changed.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		queryCacheHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_query_cache_hits_total",
+				Help: "Total number of runs of a job in which a query served its cached metrics instead of running, see sample_rate and run.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		queryCacheMisses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_query_cache_misses_total",
+				Help: "Total number of runs of a job in which a query ran on the database.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		deadlockRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_query_deadlock_retries_total",
+				Help: "Total number of times a query was retried after a deadlock or serialization failure.",
+			},
+			[]string{"sql_job", "query", "host", "database"},
+		),
+		valueCoercionErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_exporter_value_coercion_errors_total",
+				Help: "Total number of column values which couldn't be converted to a metric value, label or timestamp.",
+			},
+			[]string{"sql_job", "query", "column", "type"},
+		),
+		negativeCounterValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_exporter_negative_counter_values_total",
+				Help: "Total number of negative values of cumulative counters, see negative_counters.",
+			},
+			[]string{"sql_job", "query", "column"},
+		),
+		activeScrapes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_active_scrapes",
+				Help: "Number of scrapes currently collecting the cached query metrics.",
+			},
+		),
+		activeQueries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_active_queries",
+				Help: "Number of queries currently running on the databases.",
+			},
+			[]string{"sql_job"},
+		),
+		scrapeErrors: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "sql_exporter_scrape_errors_total",
+				Help: "Total number of metrics which were left out of a scrape of /metrics because they failed to gather.",
+			},
+		),
+		queriesWaiting: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_queries_waiting",
+				Help: "Number of queries waiting for a free slot of global_max_connections.",
+			},
+		),
+		labelCardinalityExceeded: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_label_cardinality_exceeded",
+				Help: "Whether a label of a query exceeded max_label_cardinality distinct values.",
+			},
+			[]string{"sql_job", "query", "label"},
+		),
+		configReloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sql_exporter_config_reloads_total",
+				Help: "Total number of config reloads by result.",
+			},
+			[]string{"result"},
+		),
+		configLastReloadSuccess: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "sql_exporter_config_last_reload_success_timestamp_seconds",
+				Help: "Unix timestamp of the last successful config load.",
+			},
+		),
+	}
+}
+
+// labels of the connection pool metrics
+var poolLabels = []string{"sql_job", "driver", "host", "database", "user"}
+
+// descriptors of the connection pool metrics, see sql.DBStats
+var (
+	poolOpenDesc = prometheus.NewDesc(
+		"sql_exporter_pool_open_connections",
+		"Number of established connections, both in use and idle.",
+		poolLabels, nil,
+	)
+	poolInUseDesc = prometheus.NewDesc(
+		"sql_exporter_pool_in_use_connections",
+		"Number of connections currently in use.",
+		poolLabels, nil,
+	)
+	poolIdleDesc = prometheus.NewDesc(
+		"sql_exporter_pool_idle_connections",
+		"Number of idle connections.",
+		poolLabels, nil,
+	)
+	poolWaitCountDesc = prometheus.NewDesc(
+		"sql_exporter_pool_wait_count_total",
+		"Total number of times a query waited for a free connection.",
+		poolLabels, nil,
+	)
+	poolWaitDurationDesc = prometheus.NewDesc(
+		"sql_exporter_pool_wait_duration_seconds_total",
+		"Total time queries waited for a free connection.",
+		poolLabels, nil,
+	)
+)
+
+// descriptors of the metric cache metrics, see Exporter.Collect
+var (
+	cachedMetricsDesc = prometheus.NewDesc(
+		"sql_exporter_cached_metrics",
+		"Number of metrics of a query cached over all its connections.",
+		[]string{"sql_job", "query"}, nil,
+	)
+	cacheBytesDesc = prometheus.NewDesc(
+		"sql_exporter_metric_cache_bytes",
+		"Estimated memory of the cached metrics of a query over all its connections.",
+		[]string{"sql_job", "query"}, nil,
+	)
+)
+
+// queryInfoDesc describes the metadata of a query, see Query.ExportInfo
+var queryInfoDesc = prometheus.NewDesc(
+	"sql_query_info",
+	"Metadata of a query, always 1.",
+	[]string{"sql_job", "query", "sql_hash", "driver", "interval"}, nil,
+)
+
+// estimated overhead in bytes of a cached metric and of each of its labels
+// besides the label names and values, see metricBytes
+const (
+	metricOverheadBytes = 80
+	labelOverheadBytes  = 56
+)
+
+// register registers the metrics about the exporter with reg, e.g.
+// prometheus.DefaultRegisterer
+func (s *exporterStats) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		s.queryLastSuccess,
+		s.queryUp,
+		s.queryDuration,
+		s.queryRows,
+		s.connectionQueries,
+		s.connectionUp,
+		s.connectionError,
+		s.connectionLastRun,
+		s.circuitOpen,
+		s.connectionPaused,
+		s.scrapeTimedOut,
+		s.estimatedQueries,
+		s.executedQueries,
+		s.valueCoercionErrors,
+		s.deadlockRetries,
+		s.queryCacheHits,
+		s.queryCacheMisses,
+		s.negativeCounterValues,
+		s.schemaChanges,
+		s.planChanges,
+		s.resultHashes,
+		s.querySeries,
+		s.labelCardinalityExceeded,
+		s.configReloads,
+		s.configLastReloadSuccess,
+		s.activeScrapes,
+		s.activeQueries,
+		s.queriesWaiting,
+		s.scrapeErrors,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newQueryDuration(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sql_query_duration_seconds",
+			Help:    "Duration of the runs of a query on a connection.",
+			Buckets: buckets,
+		},
+		[]string{"sql_job", "query", "host", "database"},
+	)
+}
+
+// buckets of the histograms of the exporters created from now on, see
+// setQueryDurationBuckets and setQueryRowsBuckets
+var (
+	queryDurationBuckets = prometheus.DefBuckets
+	queryRowsBuckets     = prometheus.ExponentialBuckets(1, 4, 8)
+)
+
+// setQueryDurationBuckets sets the buckets of the histogram of the query
+// durations. It has to be called before the exporter is created.
+func setQueryDurationBuckets(buckets []float64) {
+	queryDurationBuckets = buckets
+}
+
+func newQueryRows(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sql_query_rows",
+			Help:    "Number of rows of the runs of a query on a connection which updated metrics.",
+			Buckets: buckets,
+		},
+		[]string{"sql_job", "query", "host", "database"},
+	)
+}
+
+// setQueryRowsBuckets sets the buckets of the histogram of the row counts. It
+// has to be called before the exporter is created.
+func setQueryRowsBuckets(buckets []float64) {
+	queryRowsBuckets = buckets
+}
+
+// parseBuckets parses a comma separated list of increasing bucket bounds
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %s", field)
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be increasing, got %s", s)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// validMetricNameRE matches valid metric names, see
+// github.com/prometheus/common/model.IsValidMetricName
+var validMetricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// NameSanitizer replaces the characters of metric names which are not
+// allowed, see File.MetricNameSanitizer. By default MetricNameRE is removed.
+type NameSanitizer struct {
+	Regex       string `yaml:"regex"`       // matches the characters to replace
+	Replacement string `yaml:"replacement"` // may refer to groups of regex, e.g. ${1}
+	re          *regexp.Regexp
+}
+
+// defaultNameSanitizer removes all invalid characters
+var defaultNameSanitizer = &NameSanitizer{Regex: MetricNameRE.String(), re: MetricNameRE}
+
+// compile compiles the regex of the sanitizer
+func (s *NameSanitizer) compile() error {
+	re, err := regexp.Compile(s.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid metric_name_sanitizer regex: %s", err)
+	}
+	s.re = re
+	return nil
+}
+
+// sanitize applies the sanitizer to a metric name
+func (s *NameSanitizer) sanitize(name string) string {
+	return s.re.ReplaceAllString(name, s.Replacement)
+}
+
+// NameTransform turns the names of the value columns into idiomatic names
+// for the col label, e.g. of databases with camelCase or dotted column
+// names. The steps are applied in the order of the fields.
+type NameTransform struct {
+	Regex       string `yaml:"regex"`       // regex replaced by replacement, e.g. ^metric_
+	Replacement string `yaml:"replacement"` // may refer to groups of regex, e.g. ${1}
+	Delimiter   string `yaml:"delimiter"`   // replaced by _, e.g. .
+	SnakeCase   bool   `yaml:"snake_case"`  // insert _ at case changes, e.g. bytesRead to bytes_Read
+	Lowercase   bool   `yaml:"lowercase"`
+	re          *regexp.Regexp
+}
+
+// compile validates the transform and compiles its regex
+func (t *NameTransform) compile() error {
+	if t.Regex == "" {
+		if t.Replacement != "" {
+			return fmt.Errorf("name_transform replacement needs a regex")
+		}
+		return nil
+	}
+	re, err := regexp.Compile(t.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid name_transform regex: %s", err)
+	}
+	t.re = re
+	return nil
+}
+
+// apply transforms a column name
+func (t *NameTransform) apply(name string) string {
+	if t.re != nil {
+		name = t.re.ReplaceAllString(name, t.Replacement)
+	}
+	if t.Delimiter != "" {
+		name = strings.Replace(name, t.Delimiter, "_", -1)
+	}
+	if t.SnakeCase {
+		name = snakeCase(name)
+	}
+	if t.Lowercase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// snakeCase inserts an underscore before each upper case letter which
+// follows a lower case letter or a digit, e.g. rowsReadTotal becomes
+// rows_Read_Total. Acronyms are kept together, e.g. innerHTTPCalls becomes
+// inner_HTTPCalls.
+func snakeCase(name string) string {
+	var b strings.Builder
+	var prev rune
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return b.String()
+}
+
+// colName returns the value of the col label of a value column
+func (q *Query) colName(valueName string) string {
+	if q.NameTransform == nil {
+		return valueName
+	}
+	return q.NameTransform.apply(valueName)
+}
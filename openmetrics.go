@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// openMetricsInfo provides what the descriptors of the client don't know
+// about the metrics, see Exporter
+type openMetricsInfo interface {
+	// Units returns the units of the metric families by name
+	Units() map[string]string
+}
+
+// metricsHandler serves the metrics of g in the OpenMetrics text format to
+// clients which accept it, including the _created samples of the cumulative
+// queries, and in the Prometheus formats to all others. Metrics which fail to
+// gather, e.g. of a broken query, are left out and logged instead of failing
+// the whole scrape, and counted in errors, see
+// sql_exporter_scrape_errors_total.
+func metricsHandler(logger log.Logger, g prometheus.Gatherer, info openMetricsInfo, errors prometheus.Counter) http.Handler {
+	return promhttp.HandlerFor(unitGatherer{countingGatherer{g, errors}, info}, promhttp.HandlerOpts{
+		ErrorLog:                            gatherLogger{logger},
+		ErrorHandling:                       promhttp.ContinueOnError,
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
+	})
+}
+
+// countingGatherer counts the errors of a gatherer
+type countingGatherer struct {
+	prometheus.Gatherer
+	errors prometheus.Counter
+}
+
+// Gather implements prometheus.Gatherer
+func (g countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if errs, ok := err.(prometheus.MultiError); ok {
+		g.errors.Add(float64(len(errs)))
+	} else if err != nil {
+		g.errors.Inc()
+	}
+	return mfs, err
+}
+
+// unitGatherer sets the units of the metric families, see Query.Unit. The
+// client has no units in its descriptors.
+type unitGatherer struct {
+	prometheus.Gatherer
+	info openMetricsInfo
+}
+
+// Gather implements prometheus.Gatherer
+func (g unitGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	units := g.info.Units()
+	for _, mf := range mfs {
+		if unit, found := units[mf.GetName()]; found {
+			unit := unit
+			mf.Unit = &unit
+		}
+	}
+	return mfs, err
+}
+
+// gatherLogger logs the errors of promhttp
+type gatherLogger struct {
+	log log.Logger
+}
+
+// Println implements promhttp.Logger
+func (l gatherLogger) Println(v ...interface{}) {
+	level.Error(l.log).Log("msg", "Failed to gather metrics", "err", strings.TrimSpace(fmt.Sprintln(v...)))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// staticUnits is an openMetricsInfo with fixed units
+type staticUnits map[string]string
+
+// Units implements openMetricsInfo
+func (u staticUnits) Units() map[string]string {
+	return u
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	q := &Query{Name: "transactions_total", Help: "Transactions.", Cumulative: true, job: "test", log: log.NewNopLogger(), stats: newExporterStats()}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_count"}
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+	metrics, err := q.updateMetrics(nil, conn, map[string]interface{}{"metric_count": "3"}, valueNames, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metricsCollector(metrics))
+
+	srv := httptest.NewServer(metricsHandler(log.NewNopLogger(), reg, staticUnits{}, prometheus.NewCounter(prometheus.CounterOpts{Name: "errors"})))
+	defer srv.Close()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("content type %q", ct)
+	}
+	for _, want := range []string{
+		"# TYPE sql_transactions counter\n",
+		"sql_transactions_total{",
+		"sql_transactions_created{",
+		"# EOF\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// MaintenanceWindow is a recurring time in which the queries of a job or a
+// connection don't run, e.g. during planned database maintenance
+type MaintenanceWindow struct {
+	Days     []string      `yaml:"days"`     // weekdays the window starts on, e.g. sunday, every day if empty
+	Start    string        `yaml:"start"`    // local time the window starts at, e.g. 02:00
+	Duration time.Duration `yaml:"duration"` // length of the window
+	hour     int           // of the start
+	minute   int
+	days     map[time.Weekday]bool
+}
+
+// parse validates the window and sets its unexported fields
+func (w *MaintenanceWindow) parse() error {
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid maintenance window start '%s', expected e.g. 02:00", w.Start)
+	}
+	w.hour, w.minute = start.Hour(), start.Minute()
+	if w.Duration <= 0 || w.Duration > 7*24*time.Hour {
+		return fmt.Errorf("maintenance window duration must be between 0 and 7 days, is %s", w.Duration)
+	}
+	w.days = make(map[time.Weekday]bool, len(w.Days))
+	for _, day := range w.Days {
+		found := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(day, d.String()) {
+				w.days[d] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown maintenance window day '%s'", day)
+		}
+	}
+	return nil
+}
+
+// active reports whether now is in the window. A window may start on an
+// earlier day, e.g. on the evening before.
+func (w *MaintenanceWindow) active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for back := 0; back <= 7; back++ {
+		day := midnight.AddDate(0, 0, -back)
+		if len(w.days) > 0 && !w.days[day.Weekday()] {
+			continue
+		}
+		// the wall clock time, which isn't a fixed offset from midnight
+		// on days with a DST change
+		start := time.Date(day.Year(), day.Month(), day.Day(), w.hour, w.minute, 0, 0, now.Location())
+		if !now.Before(start) && now.Before(start.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseKey selects the connections of a pause, empty fields match all
+type pauseKey struct {
+	Job      string `json:"job,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Database string `json:"database,omitempty"`
+}
+
+// matches reports whether the pause applies to a connection of job
+func (k pauseKey) matches(job, host, database string) bool {
+	return (k.Job == "" || k.Job == job) &&
+		(k.Host == "" || k.Host == host) &&
+		(k.Database == "" || k.Database == database)
+}
+
+// pauseRegistry holds the end of each pause requested through /-/pause. It
+// belongs to the Exporter, so the pauses survive reloads of the config.
+type pauseRegistry struct {
+	sync.Mutex
+	pauses map[pauseKey]time.Time
+}
+
+// newPauseRegistry returns a registry without pauses
+func newPauseRegistry() *pauseRegistry {
+	return &pauseRegistry{pauses: make(map[pauseKey]time.Time)}
+}
+
+// pause pauses the connections selected by key until the given time
+func (r *pauseRegistry) pause(key pauseKey, until time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	r.pauses[key] = until
+}
+
+// resume ends the pause of key, if any
+func (r *pauseRegistry) resume(key pauseKey) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.pauses, key)
+}
+
+// paused reports whether a pause applies to a connection of job. Pauses
+// which are over are dropped.
+func (r *pauseRegistry) paused(job, host, database string) bool {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	paused := false
+	for key, until := range r.pauses {
+		if !now.Before(until) {
+			delete(r.pauses, key)
+			continue
+		}
+		if key.matches(job, host, database) {
+			paused = true
+		}
+	}
+	return paused
+}
+
+// pauseStatus is an active pause in the response of /-/pause
+type pauseStatus struct {
+	pauseKey
+	Until time.Time `json:"until"`
+}
+
+// list returns the active pauses
+func (r *pauseRegistry) list() []pauseStatus {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	list := make([]pauseStatus, 0, len(r.pauses))
+	for key, until := range r.pauses {
+		if now.Before(until) {
+			list = append(list, pauseStatus{key, until})
+		}
+	}
+	return list
+}
+
+// paused reports whether the queries of conn must not run, either due to a
+// pause or a maintenance window
+func (j *Job) paused(conn *connection) bool {
+	if j.pauses.paused(j.Name, conn.host, conn.database) {
+		return true
+	}
+	now := time.Now()
+	for i := range conn.windows {
+		if conn.windows[i].active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseHandler serves /-/pause, a POST with a duration pauses the
+// connections selected by the job, host and database parameters, e.g.
+// /-/pause?duration=30m&job=orders, and a POST to /-/resume with the same
+// parameters ends the pause early. A GET lists the active pauses.
+func pauseHandler(e *Exporter, resume bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(e.pauses.list()); err != nil {
+				level.Error(e.logger).Log("msg", "Failed to write pauses", "err", err)
+			}
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only GET and POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		key := pauseKey{Job: params.Get("job"), Host: params.Get("host"), Database: params.Get("database")}
+		if resume {
+			e.pauses.resume(key)
+			level.Info(e.logger).Log("msg", "Resumed", "job", key.Job, "host", key.Host, "db", key.Database)
+			return
+		}
+		d, err := time.ParseDuration(params.Get("duration"))
+		if err != nil || d <= 0 {
+			http.Error(w, "duration must be a positive duration, e.g. 30m", http.StatusBadRequest)
+			return
+		}
+		until := time.Now().Add(d)
+		e.pauses.pause(key, until)
+		level.Info(e.logger).Log("msg", "Paused", "until", until.Format(time.RFC3339), "job", key.Job, "host", key.Host, "db", key.Database)
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	w := &MaintenanceWindow{Days: []string{"sunday"}, Start: "04:00", Duration: time.Hour}
+	if err := w.parse(); err != nil {
+		t.Fatal(err)
+	}
+	// the clocks went from 02:00 to 03:00 on 2024-03-31 and from 03:00 back
+	// to 02:00 on 2024-10-27, both sundays
+	for _, tc := range []struct {
+		now    time.Time
+		active bool
+	}{
+		{time.Date(2024, 3, 31, 3, 30, 0, 0, loc), false},
+		{time.Date(2024, 3, 31, 4, 0, 0, 0, loc), true},
+		{time.Date(2024, 3, 31, 4, 59, 0, 0, loc), true},
+		{time.Date(2024, 3, 31, 5, 0, 0, 0, loc), false},
+		{time.Date(2024, 10, 27, 3, 30, 0, 0, loc), false},
+		{time.Date(2024, 10, 27, 4, 0, 0, 0, loc), true},
+		{time.Date(2024, 10, 27, 5, 0, 0, 0, loc), false},
+	} {
+		if active := w.active(tc.now); active != tc.active {
+			t.Errorf("active(%s) = %t, want %t", tc.now, active, tc.active)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// checkPlan explains the query on a PostgreSQL connection and counts a plan
+// change if the plan differs from the one of the last run. The costs are left
+// out of the plan since they change with the table statistics. The first plan
+// of a connection is not counted as a change. The query is explained with
+// the values of its parameters, like it runs.
+func (q *Query) checkPlan(ctx context.Context, conn *connection) error {
+	if conn.driver != "postgres" && conn.driver != "postgresql" {
+		return nil
+	}
+	query, args := q.bind(conn.driver)
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	rows, err := conn.db().QueryContext(ctx, "EXPLAIN (COSTS OFF) "+query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	h := sha256.New()
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	plan := hex.EncodeToString(h.Sum(nil))
+
+	q.Lock()
+	last, found := q.plans[conn]
+	if q.plans == nil {
+		q.plans = make(map[*connection]string)
+	}
+	q.plans[conn] = plan
+	q.Unlock()
+	if found && last != plan {
+		q.stats.planChanges.WithLabelValues(q.job, q.Name, conn.host, conn.database).Inc()
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// poolRegistry shares a single database handle, and so a single connection
+// pool, between all connections with the same key, i.e. the same DSN and
+// startup SQL. Handles are reference counted and closed once the last
+// connection released them. A handle has one database connection per
+// reference, so the connections sharing it don't wait for each other, e.g.
+// while one is pinned by a snapshot. The lifetime of its database connections
+// follows the job with the shortest interval among them.
+type poolRegistry struct {
+	sync.Mutex
+	pools map[string]*pool
+}
+
+// newPoolRegistry returns an empty pool registry
+func newPoolRegistry() *poolRegistry {
+	return &poolRegistry{pools: make(map[string]*pool)}
+}
+
+// pool is a shared database handle
+type pool struct {
+	key       string
+	db        *sqlx.DB
+	refs      int
+	intervals []time.Duration // job interval of each reference, see resize
+	labels    []string        // job, driver, host, database and user of the connection which opened it, see collectPoolStats
+}
+
+// get returns the handle for key, calling open to create it if there is none.
+// open is called without holding the lock, so slow connection attempts don't
+// block other connections. A new handle gets the labels of its first
+// connection. interval is the one of the job of the connection, it has to be
+// passed to release as well.
+func (r *poolRegistry) get(key string, labels []string, interval time.Duration, open func() (*sqlx.DB, error)) (*pool, error) {
+	r.Lock()
+	if p, found := r.pools[key]; found {
+		p.acquire(interval)
+		r.Unlock()
+		return p, nil
+	}
+	r.Unlock()
+
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	// another connection may have been faster
+	if p, found := r.pools[key]; found {
+		db.Close()
+		p.acquire(interval)
+		return p, nil
+	}
+	p := &pool{key: key, db: db, labels: labels}
+	p.acquire(interval)
+	r.pools[key] = p
+	return p, nil
+}
+
+// release drops a reference to p, taken with the given interval, and closes
+// its handle if it was the last one
+func (r *poolRegistry) release(p *pool, interval time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	p.refs--
+	for i, d := range p.intervals {
+		if d == interval {
+			p.intervals = append(p.intervals[:i], p.intervals[i+1:]...)
+			break
+		}
+	}
+	if p.refs > 0 {
+		p.resize()
+		return
+	}
+	if r.pools[p.key] == p {
+		delete(r.pools, p.key)
+	}
+	p.db.Close()
+}
+
+// each calls fn for every handle which is handed out, with the lock held
+func (r *poolRegistry) each(fn func(p *pool)) {
+	r.Lock()
+	defer r.Unlock()
+	for _, p := range r.pools {
+		fn(p)
+	}
+}
+
+// acquire adds a reference of a job with the given interval to p. It has to
+// be called with the lock of the registry held.
+func (p *pool) acquire(interval time.Duration) {
+	p.refs++
+	p.intervals = append(p.intervals, interval)
+	p.resize()
+}
+
+// resize allows one open and one idle database connection per reference of
+// p. The database connections live for two intervals of the job with the
+// shortest interval, so none of them runs with a stale connection. It has to
+// be called with the lock of the registry held.
+func (p *pool) resize() {
+	p.db.SetMaxOpenConns(p.refs)
+	p.db.SetMaxIdleConns(p.refs)
+	var shortest time.Duration
+	for _, d := range p.intervals {
+		if shortest == 0 || d < shortest {
+			shortest = d
+		}
+	}
+	p.db.SetConnMaxLifetime(shortest * 2)
+}
+
+// invalidate makes sure p isn't handed out again, e.g. because it's broken.
+// Connections still holding p keep it until they release it.
+func (r *poolRegistry) invalidate(p *pool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.pools[p.key] == p {
+		delete(r.pools, p.key)
+	}
+}
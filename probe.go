@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+// probeParamPrefix is the prefix of the request parameters which set the
+// query parameters of a probe, e.g. param_tenant=acme for :tenant
+const probeParamPrefix = "param_"
+
+// bindParams replaces the named parameters of query, e.g. :tenant, with the
+// bind variables of the driver and returns their values in order. Only the
+// names in params are replaced, so casts like ::text are left alone, and so
+// are comments, string literals and quoted identifiers, like in
+// splitStatements. The values are never part of the query.
+func bindParams(driver, query string, params map[string]string) (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if skip := skipQuoted(query, i); skip > i {
+			b.WriteString(query[i:skip])
+			i = skip - 1
+			continue
+		}
+		if c != ':' || (i > 0 && query[i-1] == ':') || (i+1 < len(query) && query[i+1] == ':') {
+			b.WriteByte(c)
+			continue
+		}
+		end := i + 1
+		for end < len(query) && (query[end] == '_' || isAlnum(query[end])) {
+			end++
+		}
+		value, found := params[query[i+1:end]]
+		if !found {
+			b.WriteByte(c)
+			continue
+		}
+		args = append(args, value)
+		switch driver {
+		case "postgres", "postgresql":
+			b.WriteString("$" + strconv.Itoa(len(args)))
+		case "sqlserver", "mssql":
+			b.WriteString("@p" + strconv.Itoa(len(args)))
+		default:
+			b.WriteByte('?')
+		}
+		i = end - 1
+	}
+	return b.String(), args
+}
+
+// skipQuoted returns the end of the comment, string literal or quoted
+// identifier starting at query[i], or i if there is none. A doubled quote
+// ends the literal and starts a new one, which has the same effect.
+func skipQuoted(query string, i int) int {
+	c := query[i]
+	switch {
+	case c == '-' && i+1 < len(query) && query[i+1] == '-':
+		if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+			return i + end
+		}
+		return len(query)
+	case c == '/' && i+1 < len(query) && query[i+1] == '*':
+		if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(query)
+	case c == '\'' || c == '"' || c == '`':
+		if end := strings.IndexByte(query[i+1:], c); end >= 0 {
+			return i + 1 + end + 1
+		}
+		return len(query)
+	}
+	return i
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// bind returns the query for the driver and the values of its parameters.
+// The parameters of a probe override the configured defaults. This is the
+// only way values get into a query, see also parseQueryTemplate.
+func (q *Query) bind(driver string) (string, []interface{}) {
+	if len(q.Params) == 0 && len(q.loopParams) == 0 {
+		return q.Query, nil
+	}
+	params := make(map[string]string, len(q.Params))
+	for name, value := range q.Params {
+		params[name] = value
+		if override, found := q.probeParams[name]; found {
+			params[name] = override
+		}
+	}
+	for name, value := range q.loopParams {
+		params[name] = value
+	}
+	return bindParams(driver, q.Query, params)
+}
+
+// probeClone returns a copy of the query for a single probe with the given
+// parameters. The copy has its own state and reports to stats instead of the
+// metrics about the exporter, so the probe doesn't affect the metrics of the
+// regular runs, e.g. sql_query_up or sql_query_result_hash.
+func (q *Query) probeClone(params map[string]string, stats *exporterStats) (*Query, error) {
+	buf, err := yaml.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	c := &Query{}
+	if err := yaml.Unmarshal(buf, c); err != nil {
+		return nil, err
+	}
+	q.Lock()
+	c.desc = q.desc
+	c.descLabels = q.descLabels
+	c.countDesc = q.countDesc
+	c.deltaDesc = q.deltaDesc
+	c.valueLabels = q.valueLabels
+	c.columns = q.columns
+	q.Unlock()
+	c.reduceDesc = q.reduceDesc
+	c.log = q.log
+	c.job = q.job
+	c.namespace = q.namespace
+	c.nameSanitizer = q.nameSanitizer
+	c.constLabels = q.constLabels
+	c.maxCardinality = q.maxCardinality
+	c.slots = q.slots
+	c.stats = stats
+	c.foldCardinality = q.foldCardinality
+	c.metrics = make(map[*connection][]prometheus.Metric)
+	c.probeParams = params
+	c.loopParams = q.loopParams
+	if err := c.initNameRegex(); err != nil {
+		return nil, err
+	}
+	// the compiled regexes are not part of the YAML
+	if c.NameTransform != nil {
+		if err := c.NameTransform.compile(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range c.RelabelConfigs {
+		if err := c.RelabelConfigs[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// probeConn returns a copy of the connection for a probe, which runs outside
+// of the run loop of the job, or nil if it's not connected. The copy never
+// uses the snapshot of a regular run.
+func (c *connection) probeConn() *connection {
+	c.handleLock.Lock()
+	defer c.handleLock.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return &connection{
+		conn:        c.conn,
+		driver:      c.driver,
+		host:        c.host,
+		database:    c.database,
+		user:        c.user,
+		labelNames:  c.labelNames,
+		labelValues: c.labelValues,
+		readOnly:    c.readOnly,
+		isolation:   c.isolation,
+		setup:       c.setup,
+		charset:     c.charset,
+	}
+}
+
+// probe runs all queries of the job once with the given parameters and
+// returns their metrics. Connections which are not connected yet are
+// skipped. The bookkeeping of the runs goes to metrics which are thrown away
+// afterwards.
+func (j *Job) probe(ctx context.Context, params map[string]string) []prometheus.Metric {
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	stats := newExporterStats()
+	var metrics []prometheus.Metric
+	for _, conn := range j.connections() {
+		probe := conn.probeConn()
+		if probe == nil {
+			level.Warn(j.log).Log("msg", "Skipping probe. Not connected", "db", conn.database)
+			continue
+		}
+		for _, q := range j.Queries {
+			if q == nil || !q.selects(conn) {
+				continue
+			}
+			c, err := q.probeClone(params, stats)
+			if err != nil {
+				level.Warn(q.log).Log("msg", "Failed to probe query", "err", err)
+				continue
+			}
+			if err := c.Run(ctx, probe); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to probe query", "err", err, "host", probe.host, "db", probe.database)
+				continue
+			}
+			metrics = append(metrics, c.metrics[probe]...)
+		}
+	}
+	return metrics
+}
+
+// metricsCollector collects a fixed set of metrics
+type metricsCollector []prometheus.Metric
+
+// Describe implements prometheus.Collector
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	seen := make(map[*prometheus.Desc]bool)
+	for _, m := range c {
+		if desc := m.Desc(); !seen[desc] {
+			seen[desc] = true
+			ch <- desc
+		}
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// probeHandler runs the queries of the job given by the job parameter for a
+// single scrape. The param_ parameters set the query parameters, e.g.
+// /probe?job=tenants&param_tenant=acme.
+func probeHandler(e *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("job")
+		params := make(map[string]string)
+		for key, values := range r.URL.Query() {
+			if strings.HasPrefix(key, probeParamPrefix) && len(values) > 0 {
+				params[strings.TrimPrefix(key, probeParamPrefix)] = values[0]
+			}
+		}
+		e.RLock()
+		var job *Job
+		for _, j := range e.jobs {
+			if j.Name == name {
+				job = j
+			}
+		}
+		e.RUnlock()
+		if job == nil {
+			http.Error(w, fmt.Sprintf("unknown job %q", name), http.StatusBadRequest)
+			return
+		}
+		reg := prometheus.NewRegistry()
+		metrics := job.probe(r.Context(), params)
+		if len(metrics) > 0 {
+			if err := reg.Register(metricsCollector(metrics)); err != nil {
+				level.Error(e.logger).Log("msg", "Failed to register probe metrics", "err", err, "job", name)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
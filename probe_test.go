@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBindParamsQuoted(t *testing.T) {
+	params := map[string]string{"tenant": "acme"}
+	for _, tc := range []struct {
+		query string
+		want  string
+		args  []interface{}
+	}{
+		{"SELECT 1 -- only :tenant\nWHERE t = :tenant", "SELECT 1 -- only :tenant\nWHERE t = $1", []interface{}{"acme"}},
+		{"SELECT 1 /* :tenant */ WHERE t = :tenant", "SELECT 1 /* :tenant */ WHERE t = $1", []interface{}{"acme"}},
+		{`SELECT ":tenant" FROM t WHERE t = :tenant`, `SELECT ":tenant" FROM t WHERE t = $1`, []interface{}{"acme"}},
+		{"SELECT 'it''s :tenant' WHERE t = :tenant", "SELECT 'it''s :tenant' WHERE t = $1", []interface{}{"acme"}},
+		{"SELECT 1 -- :tenant", "SELECT 1 -- :tenant", nil},
+	} {
+		got, args := bindParams("postgres", tc.query, params)
+		if got != tc.want {
+			t.Errorf("query %q, want %q", got, tc.want)
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%q: args %q, want %q", tc.query, args, tc.args)
+		}
+	}
+}
+
+func TestProbeCloneRelabel(t *testing.T) {
+	q := &Query{
+		Name:  "tenants",
+		Help:  "Tenants.",
+		job:   "test",
+		log:   log.NewNopLogger(),
+		stats: newExporterStats(),
+		RelabelConfigs: []RelabelRule{
+			{SourceLabels: []string{"state"}, TargetLabel: "status"},
+			{Action: relabelLabelDrop, Regex: "state"},
+		},
+	}
+	for i := range q.RelabelConfigs {
+		if err := q.RelabelConfigs[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_count", "state"}
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+
+	c, err := q.probeClone(map[string]string{"tenant": "acme"}, newExporterStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string]interface{}{"metric_count": "3", "state": "ok"}
+	metrics, err := c.updateMetrics(nil, conn, res, valueNames, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("%d metrics, want 1", len(metrics))
+	}
+	var pb dto.Metric
+	if err := metrics[0].Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	for _, lp := range pb.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	if labels["status"] != "ok" {
+		t.Errorf("status %q, want %q", labels["status"], "ok")
+	}
+	if _, found := labels["state"]; found {
+		t.Errorf("state not dropped: %v", labels)
+	}
+}
+
+func TestProbeStats(t *testing.T) {
+	q := &Query{Name: "tenants", Help: "Tenants.", job: "test", log: log.NewNopLogger(), stats: newExporterStats()}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_count"}
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+
+	stats := newExporterStats()
+	c, err := q.probeClone(nil, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the value can't be converted, which is counted
+	res := map[string]interface{}{"metric_count": "three"}
+	c.updateMetrics(nil, conn, res, valueNames, nil)
+
+	for s, want := range map[*exporterStats]int{q.stats: 0, stats: 1} {
+		reg := prometheus.NewRegistry()
+		if err := s.register(reg); err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, mf := range mfs {
+			if mf.GetName() == "sql_exporter_value_coercion_errors_total" {
+				count = len(mf.GetMetric())
+			}
+		}
+		if count != want {
+			t.Errorf("%d coercion error series, want %d", count, want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// defaultPorts are the ports the drivers connect to if the URL has none
+var defaultPorts = map[string]string{
+	"postgres":   "5432",
+	"postgresql": "5432",
+	"mysql":      "3306",
+	"sqlserver":  "1433",
+	"clickhouse": "9000",
+}
+
+// forwarder accepts connections on a local port and forwards them to the
+// database through a SOCKS5 proxy. The DSN of the connection points to the
+// local port instead of the database, so it works with every driver.
+type forwarder struct {
+	log    log.Logger
+	ln     net.Listener
+	proxy  *url.URL
+	target string
+}
+
+// newForwarder starts forwarding a local port to target through proxy
+func newForwarder(logger log.Logger, proxy *url.URL, target string) (*forwarder, error) {
+	if proxy.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %s", proxy.Scheme)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{log: logger, ln: ln, proxy: proxy, target: target}
+	go f.serve()
+	return f, nil
+}
+
+// addr returns the local address to connect to
+func (f *forwarder) addr() string {
+	return f.ln.Addr().String()
+}
+
+// close stops accepting new connections, forwarded ones are left running
+func (f *forwarder) close() {
+	f.ln.Close()
+}
+
+func (f *forwarder) serve() {
+	for {
+		local, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.forward(local)
+	}
+}
+
+// forward copies data between local and target until either side is closed
+func (f *forwarder) forward(local net.Conn) {
+	remote, err := dialSOCKS5(f.proxy, f.target)
+	if err != nil {
+		level.Warn(f.log).Log("msg", "Failed to connect through proxy", "proxy", f.proxy.Host, "target", f.target, "err", err)
+		local.Close()
+		return
+	}
+	go func() {
+		io.Copy(remote, local)
+		remote.Close()
+	}()
+	io.Copy(local, remote)
+	local.Close()
+}
+
+// dialSOCKS5 opens a connection to target through a SOCKS5 proxy, see RFC
+// 1928 and RFC 1929 for the username/password authentication
+func dialSOCKS5(proxy *url.URL, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long")
+	}
+	conn, err := net.DialTimeout("tcp", proxy.Host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := socks5Handshake(conn, proxy.User, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Handshake authenticates with the proxy and asks it to connect to the
+// target
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	// offer no authentication, or username/password if configured
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 || resp[1] != method {
+		return fmt.Errorf("proxy refused the authentication method")
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(pass) > 255 {
+			return fmt.Errorf("proxy credentials too long")
+		}
+		req := append([]byte{0x01, byte(len(name))}, name...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return fmt.Errorf("proxy authentication failed")
+		}
+	}
+
+	// CONNECT to the target by name, the proxy resolves it
+	req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("proxy failed to connect, reply code %d", head[1])
+	}
+	// skip the bound address
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("proxy replied with unknown address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// proxyTarget returns the host:port the URL of a connection points to
+func proxyTarget(u *url.URL) (string, error) {
+	host := u.Host
+	if host == "" {
+		return "", fmt.Errorf("connection has no host")
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	port, found := defaultPorts[u.Scheme]
+	if !found {
+		return "", fmt.Errorf("no default port for %s, set it in the URL", u.Scheme)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// proxiedURL returns a copy of u which points to the local forwarder addr
+func proxiedURL(u *url.URL, addr string) *url.URL {
+	proxied := *u
+	proxied.Host = addr
+	return &proxied
+}
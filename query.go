@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
-// Run executes a single Query on a single connection
-func (q *Query) Run(conn *connection) error {
+// Run executes a single Query on a single connection. The query is canceled
+// when ctx is done.
+func (q *Query) Run(ctx context.Context, conn *connection) error {
 	if q.log == nil {
 		q.log = log.NewNopLogger()
 	}
@@ -25,44 +32,231 @@ func (q *Query) Run(conn *connection) error {
 	if conn == nil || conn.conn == nil {
 		return fmt.Errorf("db connection not initialized (should not happen)")
 	}
-	// execute query
-	rows, err := conn.conn.Queryx(q.Query)
+	if err := q.slots.acquire(ctx); err != nil {
+		return err
+	}
+	defer q.slots.release()
+	q.stats.activeQueries.WithLabelValues(q.job).Inc()
+	defer q.stats.activeQueries.WithLabelValues(q.job).Dec()
+	start := time.Now()
+	defer func() {
+		q.stats.queryDuration.WithLabelValues(q.job, q.Name, conn.host, conn.database).Observe(time.Since(start).Seconds())
+	}()
+	// replicas may lag behind, so an empty result is retried if configured,
+	// and so are deadlocks, except in a snapshot which they abort
+	retry, deadlocks := 0, 0
+	for {
+		err := q.run(ctx, conn)
+		delay := q.ZeroRowsRetryDelay
+		switch {
+		case isDeadlock(conn.driver, err) && deadlocks < q.DeadlockRetries && conn.tx == nil:
+			deadlocks++
+			q.stats.deadlockRetries.WithLabelValues(q.job, q.Name, conn.host, conn.database).Inc()
+			level.Debug(q.log).Log("msg", "Retrying query. Deadlock", "retry", deadlocks, "err", err, "host", conn.host, "db", conn.database)
+			delay = q.DeadlockRetryDelay
+		case err == errZeroRows && retry < q.ZeroRowsRetries:
+			retry++
+			level.Debug(q.log).Log("msg", "Retrying query. Zero rows returned", "retry", retry, "host", conn.host, "db", conn.database)
+		default:
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run executes the query once and replaces the cached metrics of conn on
+// success
+func (q *Query) run(ctx context.Context, conn *connection) error {
+	rows, err := q.query(ctx, conn)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
+	// the columns may have changed since the descriptor was set up
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if cols, err = q.positionColumns(cols); err != nil {
+		return err
+	}
+	if cols, err = q.checkDuplicates(conn, cols); err != nil {
+		return err
+	}
+	// the column names are the same for every row
+	valueNames := q.filterColumns(cols)
+	var single string
+	if q.Format == formatSingle {
+		single, err = q.singleColumn(cols)
+		if err != nil {
+			return err
+		}
+	}
+	q.updateDesc(conn, valueNames)
 
-	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.metrics))
+	q.resetCounts(conn)
+	q.resetCumulative(conn)
+	q.resetDeltas(conn)
+	returned, updated := 0, 0
+	// rows with identical label values are folded into one metric,
+	// otherwise they would be rejected as duplicate series
+	var agg *aggregation
+	var metrics []prometheus.Metric
+	if q.Aggregation != "" {
+		agg = newAggregation(q.Aggregation, q.labelNames(conn.labelNames, valueNames))
+	} else {
+		// the drivers can't tell the row count in advance, the last result
+		// is the best guess and saves growing the slice for large results
+		metrics = make([]prometheus.Metric, 0, q.lastCount(conn))
+		if q.foldCardinality && q.maxCardinality > 0 {
+			agg = q.newFoldAggregation(q.labelNames(conn.labelNames, valueNames))
+		}
+	}
+	var hash resultHash
+	var red *reducer
+	if q.Reduce != nil {
+		red = &reducer{fn: q.Reduce.Func}
+	}
+	expected := q.newExpectedSeen()
+	var raw []rawValue
+	scanner := newRowScanner(cols)
 	for rows.Next() {
-		res := make(map[string]interface{})
-		err := rows.MapScan(res)
+		returned++
+		res, err := scanner.scan(rows)
 		if err != nil {
 			level.Error(q.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
 			continue
 		}
-		m, err := q.updateMetrics(conn, res)
+		if q.DebugRawValues {
+			// before any conversion
+			raw = debugRawValues(res)
+		}
+		if err := q.extractJSON(res); err != nil {
+			level.Error(q.log).Log("msg", "Failed to extract JSON", "err", err, "host", conn.host, "db", conn.database)
+			continue
+		}
+		if q.ResultHash {
+			hash.add(res)
+		}
+		if expected != nil {
+			expected.add(res)
+		}
+		if red != nil {
+			if err := red.add(q.Reduce.Column, res[q.Reduce.Column]); err != nil {
+				q.coercionError(q.Reduce.Column, res[q.Reduce.Column])
+				level.Error(q.log).Log("msg", "Failed to reduce", "err", err, "host", conn.host, "db", conn.database)
+			}
+		}
+		// the metrics of each row are appended to metrics directly
+		if single != "" {
+			metrics, err = q.updateRow(metrics, conn, res, single, nil, agg)
+		} else if q.Format == formatInfo {
+			metrics, err = q.updateRow(metrics, conn, res, "", valueNames, agg)
+		} else {
+			metrics, err = q.updateMetrics(metrics, conn, res, valueNames, agg)
+		}
 		if err != nil {
 			level.Error(q.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
 			continue
 		}
-		metrics = append(metrics, m...)
 		updated++
 	}
+	if q.DebugRawValues {
+		// also if no row could be parsed, which is what they help with
+		q.Lock()
+		if q.rawValues == nil {
+			q.rawValues = make(map[*connection][]rawValue)
+		}
+		q.rawValues[conn] = raw
+		q.Unlock()
+	}
 
-	if updated < 1 {
-		return fmt.Errorf("zero rows returned")
+	// rows.Next stops early if the query was canceled
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	q.stats.queryRows.WithLabelValues(q.job, q.Name, conn.host, conn.database).Observe(float64(updated))
+	if expected != nil {
+		// e.g. a status without any rows exports 0 instead of no series
+		for _, res := range expected.missing(q, valueNames) {
+			if metrics, err = q.updateMetrics(metrics, conn, res, valueNames, agg); err != nil {
+				level.Error(q.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
+			}
+		}
+	}
+	if err := q.checkRows(returned, updated); err != nil {
+		return err
+	}
+	if single != "" && updated > 1 && (agg == nil || agg.foldedOnly) {
+		return fmt.Errorf("format single expects one row, got %d", updated)
 	}
 
-	// update the metrics cache
+	if agg != nil {
+		aggregated, err := agg.metrics(func(labels []string, value float64, ts time.Time) (prometheus.Metric, error) {
+			return q.newMetric(conn, labels, value, ts, time.Time{})
+		})
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, aggregated...)
+	}
+	// duplicate series would make the registry fail the whole scrape
+	metrics = q.dropDuplicates(conn, metrics)
+	if len(q.CountColumns) > 0 {
+		counts, err := q.countMetrics(conn)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, counts...)
+	}
+	if red != nil {
+		m, err := q.reduceMetric(conn, red)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	if q.Delta {
+		deltas, err := q.deltaMetrics(conn)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, deltas...)
+	}
+
+	if q.Cumulative {
+		q.pruneCumulative(conn)
+	}
+	// update the metrics cache, its size is estimated once per run
+	bytes := 0
+	for _, m := range metrics {
+		bytes += metricBytes(m)
+	}
 	q.Lock()
 	q.metrics[conn] = metrics
+	if q.metricsBytes == nil {
+		q.metricsBytes = make(map[*connection]int)
+	}
+	q.metricsBytes[conn] = bytes
 	q.Unlock()
+	q.stats.queryLastSuccess.WithLabelValues(q.job, q.Name, conn.host, conn.database).SetToCurrentTime()
+	q.stats.querySeries.WithLabelValues(q.job, q.Name, conn.host, conn.database).Set(float64(len(metrics)))
+	if q.ResultHash {
+		q.stats.resultHashes.WithLabelValues(q.job, q.Name, conn.host, conn.database).Set(hash.value())
+	}
 
 	return nil
 }
 
-func (q *Query) SetDesc(conn *connection, jobName string) error {
+// SetDesc runs the query to set up the descriptor from its columns and checks
+// the column types. The query is canceled when ctx is done.
+func (q *Query) SetDesc(ctx context.Context, conn *connection) error {
 	if q.log == nil {
 		q.log = log.NewNopLogger()
 	}
@@ -72,61 +266,489 @@ func (q *Query) SetDesc(conn *connection, jobName string) error {
 	if conn == nil || conn.conn == nil {
 		return fmt.Errorf("db connection not initialized (should not happen)")
 	}
+	// it runs the full query, so it counts against global_max_connections
+	if err := q.slots.acquire(ctx); err != nil {
+		return err
+	}
+	defer q.slots.release()
+	q.stats.activeQueries.WithLabelValues(q.job).Inc()
+	defer q.stats.activeQueries.WithLabelValues(q.job).Dec()
 	// execute query
-	rows, err := conn.conn.Queryx(q.Query)
+	rows, err := q.query(ctx, conn)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	updated := 0
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if cols, err = q.positionColumns(cols); err != nil {
+		return err
+	}
+	if cols, err = q.checkDuplicates(conn, cols); err != nil {
+		return err
+	}
+	scanner := newRowScanner(cols)
+	valueNames := q.filterColumns(cols)
+	if q.Format == formatSingle {
+		single, err := q.singleColumn(cols)
+		if err != nil {
+			return err
+		}
+		// the value column is checked like a metric column
+		valueNames = []string{single}
+	}
+	returned, updated := 0, 0
 	for rows.Next() {
-		res := make(map[string]interface{})
-		err := rows.MapScan(res)
+		returned++
+		res, err := scanner.scan(rows)
 		if err != nil {
 			level.Error(q.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
 			continue
 		}
-		keys := reflect.ValueOf(res).MapKeys()
-		valueNames := make([]string, len(keys))
-		for i := 0; i < len(keys); i++ {
-			valueNames[i] = keys[i].String()
+		if err := q.extractJSON(res); err != nil {
+			level.Error(q.log).Log("msg", "Failed to extract JSON", "err", err, "host", conn.host, "db", conn.database)
+			continue
+		}
+		if updated == 0 {
+			q.checkTypes(conn, res, valueNames)
 		}
-
-		labels := append(q.Labels, "driver", "host", "database", "user", "col")
-		q.desc = prometheus.NewDesc(
-			MetricNameRE.ReplaceAllString("sql_" + q.Name, ""),
-			q.Help,
-			append(labels, valueNames...),
-			prometheus.Labels{
-				"sql_job": jobName,
-			},
-		)
 		updated++
 	}
+	// rows.Next stops early if the query was canceled
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	q.updateDesc(conn, q.filterColumns(cols))
+	return q.checkRows(returned, updated)
+}
+
+// errZeroRows is returned by runs without any rows
+var errZeroRows = errors.New("zero rows returned")
+
+// checkRows fails a run with no usable rows. An empty result is fine for
+// queries with empty_result "ok", e.g. a list of errors.
+func (q *Query) checkRows(returned, updated int) error {
+	if returned == 0 {
+		if q.EmptyResult == emptyResultOK {
+			return nil
+		}
+		return errZeroRows
+	}
 	if updated < 1 {
-		return fmt.Errorf("zero rows returned")
+		return fmt.Errorf("none of %d rows could be parsed", returned)
 	}
 	return nil
 }
 
+// updateDesc rebuilds the descriptor if the columns of the query changed,
+// e.g. after a schema migration
+func (q *Query) updateDesc(conn *connection, valueNames []string) {
+	q.Lock()
+	defer q.Unlock()
+	if q.columns != nil && equalStrings(q.columns, valueNames) {
+		return
+	}
+	if q.columns != nil {
+		level.Warn(q.log).Log("msg", "Columns changed, rebuilding descriptor", "old", strings.Join(q.columns, ","), "new", strings.Join(valueNames, ","), "host", conn.host, "db", conn.database)
+		q.stats.schemaChanges.WithLabelValues(q.job, q.Name).Inc()
+	}
+	q.columns = valueNames
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+}
 
-// updateMetrics parses the result set and returns a slice of const metrics
-func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
-	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.Values))
+// metricName returns the metric name of the query, which is prefixed with
+// sql_ and the namespace of the job, if any, and stripped of invalid
+// characters, see File.MetricNameSanitizer. Info metrics get an _info suffix.
+func (q *Query) metricName() string {
+	prefix := "sql_"
+	if q.namespace != "" {
+		prefix += q.namespace + "_"
+	}
+	sanitizer := q.nameSanitizer
+	if sanitizer == nil {
+		sanitizer = defaultNameSanitizer
+	}
+	name := sanitizer.sanitize(prefix + q.Name)
+	if q.Format == formatInfo && !strings.HasSuffix(name, "_info") {
+		name += "_info"
+	}
+	return name
+}
 
-	keys := reflect.ValueOf(res).MapKeys()
-	valueNames := make([]string, len(keys))
+// getDesc returns the current descriptor
+func (q *Query) getDesc() *prometheus.Desc {
+	q.Lock()
+	defer q.Unlock()
+	return q.desc
+}
 
-	for i := 0; i < len(keys); i++ {
-		valueNames[i] = keys[i].String()
+// equalStrings reports whether a and b contain the same strings in the same
+// order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRun reports whether the query succeeded on conn before
+func (q *Query) hasRun(conn *connection) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, found := q.metrics[conn]
+	return found
+}
+
+// lastCount returns the number of cached metrics of the last run on conn
+func (q *Query) lastCount(conn *connection) int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.metrics[conn])
+}
+
+// sampled reports whether the query is due on conn, i.e. on every SampleRate-th
+// run of the job. Queries without cached metrics on conn are always due.
+func (q *Query) sampled(conn *connection) bool {
+	if q.SampleRate <= 1 {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	if _, found := q.metrics[conn]; !found || q.skipped[conn] >= q.SampleRate-1 {
+		delete(q.skipped, conn)
+		return true
+	}
+	if q.skipped == nil {
+		q.skipped = make(map[*connection]int)
+	}
+	q.skipped[conn]++
+	return false
+}
+
+// initNameRegex compiles the name regex. The named group "name" replaces the
+// metric column name in the "col" label, all other named groups are exported
+// as labels.
+func (q *Query) initNameRegex() error {
+	q.nameRE = nil
+	q.nameLabels = nil
+	if q.NameRegex == "" {
+		return nil
+	}
+	if q.NameColumn == "" {
+		return fmt.Errorf("name_regex requires a name_column")
+	}
+	re, err := regexp.Compile(q.NameRegex)
+	if err != nil {
+		return fmt.Errorf("invalid name_regex: %s", err)
+	}
+	for _, group := range re.SubexpNames() {
+		if group == "" || group == "name" {
+			continue
+		}
+		if !LabelNameRE.MatchString(group) || reservedLabel(group) {
+			return fmt.Errorf("invalid label name '%s' in name_regex", group)
+		}
+		q.nameLabels = append(q.nameLabels, group)
+	}
+	q.nameRE = re
+	return nil
+}
+
+// matchName applies the name regex to the name column of a row. It returns the
+// metric name, which is empty if the regex has no "name" group, and the values
+// of the captured labels in the order of q.nameLabels. ok is false if the row
+// doesn't match.
+func (q *Query) matchName(res map[string]interface{}) (name string, labels []string, ok bool) {
+	var raw string
+	switch str := res[q.NameColumn].(type) {
+	case string:
+		raw = str
+	case []uint8:
+		raw = string(str)
+	default:
+		return "", nil, false
+	}
+	match := q.nameRE.FindStringSubmatch(raw)
+	if match == nil {
+		return "", nil, false
+	}
+	labels = make([]string, 0, len(q.nameLabels))
+	for i, group := range q.nameRE.SubexpNames() {
+		switch group {
+		case "":
+		case "name":
+			name = match[i]
+		default:
+			labels = append(labels, match[i])
+		}
+	}
+	return name, labels, true
+}
+
+// queryxContext is the context aware version of sqlx.DB.Queryx, which the
+// vendored sqlx lacks
+func queryxContext(ctx context.Context, db *sqlx.DB, query string, args ...interface{}) (*sqlx.Rows, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlx.Rows{Rows: rows, Mapper: db.Mapper}, nil
+}
+
+// query executes the query on conn. Streaming queries on PostgreSQL fetch
+// their result through a cursor, the other drivers already read the result
+// row by row.
+func (q *Query) query(ctx context.Context, conn *connection) (resultRows, error) {
+	if q.Streaming && (conn.driver == "postgres" || conn.driver == "postgresql") {
+		return queryCursor(ctx, conn, q.Isolation, q.SetupQueries, q.Query)
+	}
+	query, args := q.bind(conn.driver)
+	return conn.query(ctx, q.Isolation, q.SetupQueries, query, args...)
+}
+
+// selects reports whether the query runs on the given connection, i.e. if
+// the connection has all the labels of the connection selector and its
+// allow and deny lists admit the query
+func (q *Query) selects(conn *connection) bool {
+	// a guardrail of the connection, whatever job the query belongs to
+	if !conn.allows(q.Name) {
+		return false
+	}
+	for name, value := range q.ConnectionSelector {
+		if conn.label(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTypes warns once about columns of the first row which can't be
+// converted for their role, see typeErrors
+func (q *Query) checkTypes(conn *connection, res map[string]interface{}, valueNames []string) {
+	q.Lock()
+	checked := q.typesChecked
+	q.typesChecked = true
+	q.Unlock()
+	if checked {
+		return
+	}
+	for _, e := range q.typeErrors(res, valueNames) {
+		level.Warn(q.log).Log("msg", e.reason, "column", e.column, "type", e.typ, "host", conn.host, "db", conn.database)
+	}
+}
+
+// typeError is a column which can't be converted for its role
+type typeError struct {
+	column string
+	typ    string // Go type of the value
+	reason string
+}
+
+// typeErrors returns the columns of a row which can't be converted for their
+// role, i.e. metric columns which are not numeric and label columns which are
+// not text. NULL values are not checked.
+func (q *Query) typeErrors(res map[string]interface{}, valueNames []string) []typeError {
+	// info metrics accept columns of any type
+	if q.Format == formatInfo {
+		return nil
+	}
+	var errs []typeError
+	for _, name := range valueNames {
+		i := res[name]
+		if i == nil {
+			continue
+		}
+		if strings.HasPrefix(name, "metric_") || q.Format == formatSingle {
+			if _, err := parseValue(name, i); err != nil {
+				errs = append(errs, typeError{column: name, typ: fmt.Sprintf("%T", i), reason: "Metric column is not numeric"})
+			}
+			continue
+		}
+		// mapped columns may be of any type
+		if _, mapped := q.ValueMap[name]; mapped {
+			continue
+		}
+		switch i.(type) {
+		case string, []uint8, time.Time:
+		default:
+			errs = append(errs, typeError{column: name, typ: fmt.Sprintf("%T", i), reason: "Label column is not text"})
+		}
+	}
+	return errs
+}
+
+// defaultColLabel is the label holding the name of the value column
+const defaultColLabel = "col"
+
+// reservedLabels are added to every metric, in this order, after the labels
+// configured for the query
+var reservedLabels = []string{"driver", "host", "database", "user"}
+
+// reservedLabel reports whether name is used by the exporter itself
+func reservedLabel(name string) bool {
+	if name == "sql_job" || name == defaultColLabel {
+		return true
+	}
+	for _, l := range reservedLabels {
+		if name == l {
+			return true
+		}
+	}
+	return false
+}
+
+// colLabel returns the name of the label holding the value column, or an
+// empty string if the query disabled it or has format single or info
+func (q *Query) colLabel() string {
+	if q.Format == formatSingle || q.Format == formatInfo {
+		return ""
+	}
+	if q.ColLabel == nil {
+		return defaultColLabel
+	}
+	return *q.ColLabel
+}
+
+// labelNames returns the variable label names of the query descriptor. The
+// order must match the label values built in updateMetric.
+func (q *Query) labelNames(connLabels, valueNames []string) []string {
+	names := make([]string, 0, len(q.Labels)+len(reservedLabels)+1+len(connLabels)+len(q.nameLabels)+len(valueNames))
+	names = append(names, q.Labels...)
+	names = append(names, reservedLabels...)
+	if col := q.colLabel(); col != "" {
+		names = append(names, col)
+	}
+	names = append(names, connLabels...)
+	names = append(names, q.nameLabels...)
+	return append(names, valueNames...)
+}
+
+// dropDuplicates removes metrics with a label set that was already seen,
+// keeping the first one. Use an aggregation to merge them instead.
+func (q *Query) dropDuplicates(conn *connection, metrics []prometheus.Metric) []prometheus.Metric {
+	seen := make(map[string]struct{}, len(metrics))
+	unique := metrics[:0]
+	for _, m := range metrics {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			level.Error(q.log).Log("msg", "Failed to write metric", "err", err, "host", conn.host, "db", conn.database)
+			continue
+		}
+		pairs := make([]string, 0, len(pb.Label))
+		for _, lp := range pb.Label {
+			pairs = append(pairs, lp.GetName()+"="+strconv.Quote(lp.GetValue()))
+		}
+		key := strings.Join(pairs, ",")
+		if _, found := seen[key]; found {
+			level.Warn(q.log).Log("msg", "Dropping duplicate series", "labels", key, "host", conn.host, "db", conn.database)
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, m)
+	}
+	return unique
+}
+
+// filterColumns returns the sorted column names without the timestamp and
+// name columns, plus the labels with a default value which are missing from
+// cols. The order has to be stable since it defines the order of the label
+// values.
+func (q *Query) filterColumns(cols []string) []string {
+	valueNames := make([]string, 0, len(cols)+len(q.LabelDefaults))
+	if q.Format == formatSingle {
+		// the only column holds the value, there are no label columns
+		return valueNames
+	}
+	for _, col := range cols {
+		// dropped by positionColumns
+		if col == "" || col == q.TimestampColumn || col == q.CreatedColumn {
+			continue
+		}
+		if q.nameRE != nil && col == q.NameColumn {
+			continue
+		}
+		valueNames = append(valueNames, col)
+	}
+	for name := range q.LabelDefaults {
+		found := false
+		for _, col := range cols {
+			if col == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			valueNames = append(valueNames, name)
+		}
+	}
+	sort.Strings(valueNames)
+	return valueNames
+}
+
+// singleColumn returns the value column of a query with format single, i.e.
+// the only column besides the timestamp column
+func (q *Query) singleColumn(cols []string) (string, error) {
+	var single string
+	for _, col := range cols {
+		if col == "" || col == q.TimestampColumn || col == q.CreatedColumn {
+			continue
+		}
+		if single != "" {
+			return "", fmt.Errorf("format single expects one column, got %s", strings.Join(cols, ","))
+		}
+		single = col
+	}
+	if single == "" {
+		return "", fmt.Errorf("format single expects one column, got none")
+	}
+	return single, nil
+}
+
+// updateRow parses a row which yields exactly one metric, i.e. of a query
+// with format single or info, and appends it to metrics
+func (q *Query) updateRow(metrics []prometheus.Metric, conn *connection, res map[string]interface{}, valueName string, valueNames []string, agg *aggregation) ([]prometheus.Metric, error) {
+	m, err := q.updateMetric(conn, res, valueName, valueNames, nil, agg)
+	if err != nil || m == nil {
+		return metrics, err
+	}
+	return append(metrics, m), nil
+}
+
+// nameMatch is the result of the name regex for a single row
+type nameMatch struct {
+	col    string   // replaces the metric column name, if not empty
+	labels []string // values of the labels captured by the name regex
+}
+
+// updateMetrics parses a row of the result set and appends its const metrics
+// to metrics. valueNames are the sorted column names, see filterColumns. If
+// agg is not nil the values are folded into agg instead.
+func (q *Query) updateMetrics(metrics []prometheus.Metric, conn *connection, res map[string]interface{}, valueNames []string, agg *aggregation) ([]prometheus.Metric, error) {
+	updated := 0
+
+	var name *nameMatch
+	if q.nameRE != nil {
+		col, labels, ok := q.matchName(res)
+		if !ok {
+			// rows which don't match are ignored, e.g. unwanted status variables
+			level.Debug(q.log).Log("msg", "Skipping row, name didn't match", "host", conn.host, "db", conn.database)
+			return metrics, nil
+		}
+		name = &nameMatch{col: col, labels: labels}
 	}
 
 	for _, valueName := range valueNames {
 		if !strings.HasPrefix(valueName, "metric_") {
 			continue
 		}
-		m, err := q.updateMetric(conn, res, valueName, valueNames)
+		m, err := q.updateMetric(conn, res, valueName, valueNames, name, agg)
 		if err != nil {
 			level.Error(q.log).Log(
 				"msg", "Failed to update metric",
@@ -137,55 +759,50 @@ func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]p
 			)
 			continue
 		}
-		metrics = append(metrics, m)
+		if m != nil {
+			metrics = append(metrics, m)
+		}
 		updated++
 	}
 	if updated < 1 {
-		return nil, fmt.Errorf("zero values found")
+		return metrics, fmt.Errorf("zero values found")
 	}
 	return metrics, nil
 }
 
 // updateMetrics parses a single row and returns a const metric
-func (q *Query) updateMetric(conn *connection, res map[string]interface{}, valueName string, valueNames []string) (prometheus.Metric, error) {
+func (q *Query) updateMetric(conn *connection, res map[string]interface{}, valueName string, valueNames []string, name *nameMatch, agg *aggregation) (prometheus.Metric, error) {
 	var value float64
-	if i, ok := res[valueName]; ok {
-		switch f := i.(type) {
-		case int:
-			value = float64(f)
-		case int32:
-			value = float64(f)
-		case int64:
-			value = float64(f)
-		case uint:
-			value = float64(f)
-		case uint32:
-			value = float64(f)
-		case uint64:
-			value = float64(f)
-		case float32:
-			value = float64(f)
-		case float64:
-			value = float64(f)
-		case []uint8:
-			val, err := strconv.ParseFloat(string(f), 64)
-			if err != nil {
-				return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
-			}
-			value = val
-		case string:
-			val, err := strconv.ParseFloat(f, 64)
-			if err != nil {
-				return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
-			}
-			value = val
-		default:
-			return nil, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
+	if q.Format == formatInfo {
+		value = 1
+	} else if i, ok := res[valueName]; ok {
+		val, err := parseValue(valueName, i)
+		if err != nil {
+			q.coercionError(valueName, i)
+			return nil, err
+		}
+		value = val
+	}
+	if q.Cumulative && value < 0 {
+		q.stats.negativeCounterValues.WithLabelValues(q.job, q.Name, valueName).Inc()
+		switch q.NegativeCounters {
+		case negativeReject:
+			return nil, fmt.Errorf("Column '%s' of a counter is negative (val: %g)", valueName, value)
+		case negativeClamp:
+			value = 0
 		}
 	}
+	ts, err := q.timestamp(res)
+	if err != nil {
+		return nil, err
+	}
+	created, err := q.timeColumn(q.CreatedColumn, res)
+	if err != nil {
+		return nil, err
+	}
 	// make space for all defined variable label columns and the "static" labels
-	// added below
-	labels := make([]string, 0, len(q.Labels)+5)
+	// added below, so the slice never has to grow
+	labels := make([]string, 0, len(q.Labels)+len(reservedLabels)+1+len(conn.labelValues)+len(q.nameLabels)+len(valueNames))
 	//for _, label := range valueNames {
 	for _, label := range labels {
 		// we need to fill every spot in the slice or the key->value mapping
@@ -210,25 +827,210 @@ func (q *Query) updateMetric(conn *connection, res map[string]interface{}, value
 	labels = append(labels, conn.host)
 	labels = append(labels, conn.database)
 	labels = append(labels, conn.user)
-	labels = append(labels, valueName)
+	if q.colLabel() != "" {
+		if name != nil && name.col != "" {
+			labels = append(labels, q.colName(name.col))
+		} else {
+			labels = append(labels, q.colName(valueName))
+		}
+	}
+	labels = append(labels, conn.labelValues...)
+	// rows with folded labels may become identical, see FoldHighCardinality
+	folded := false
+	if name != nil {
+		for i, lv := range name.labels {
+			lv, f := q.limitCardinality(q.nameLabels[i], q.sanitizeLabel(q.nameLabels[i], lv))
+			folded = folded || f
+			labels = append(labels, lv)
+		}
+	}
 
-	for _, name := range  valueNames {
+	for _, name := range valueNames {
 		lv := ""
-		if i, ok := res[name]; ok {
+		vm, mapped := q.ValueMap[name]
+		i, ok := res[name]
+		if !ok {
+			// the query didn't select the column this time
+			lv = q.LabelDefaults[name]
+		} else if i == nil && q.NullLabel != nil && !strings.HasPrefix(name, "metric_") {
+			// NULL is told apart from an empty string, the value map doesn't
+			// apply
+			lv, f := q.limitCardinality(name, *q.NullLabel)
+			folded = folded || f
+			labels = append(labels, lv)
+			continue
+		} else {
 			switch str := i.(type) {
 			case string:
 				lv = str
 			case []uint8:
-				lv = string(str)
+				lv = conn.text(str)
+			case time.Time:
+				lv = q.formatTime(name, str)
 			default:
-				return nil, fmt.Errorf("Column '%s' must be type text (string)", name)
+				if !mapped && q.Format != formatInfo {
+					q.coercionError(name, i)
+					return nil, fmt.Errorf("Column '%s' must be type text (string)", name)
+				}
+				// mapped columns and the columns of info metrics may be of
+				// any type, e.g. an integer status
+				if i != nil {
+					lv = fmt.Sprint(i)
+				}
 			}
 		}
+		if ok && lv == "" && q.EmptyLabel != "" && !strings.HasPrefix(name, "metric_") {
+			lv = q.EmptyLabel
+		}
+		if mapped {
+			lv = vm.translate(lv)
+		}
+		lv = q.sanitizeLabel(name, lv)
+		// the labels of metric columns hold the value, they are not limited
+		if !strings.HasPrefix(name, "metric_") {
+			var f bool
+			lv, f = q.limitCardinality(name, lv)
+			folded = folded || f
+		}
 		labels = append(labels, lv)
 	}
 
+	if q.counted(valueName) {
+		q.countRow(conn, labels, valueNames)
+	}
+	if agg != nil && (!agg.foldedOnly || folded) {
+		agg.add(labels, value, ts)
+		return nil, nil
+	}
+	if q.Cumulative {
+		// the descriptor has no labels of metric columns, see setDesc
+		labels = withoutValues(labels, valueNames)
+	}
+
 	// create a new immutable const metric that can be cached and returned on
 	// every scrape. Remember that the order of the lable values in the labels
 	// slice must match the order of the label names in the descriptor!
-	return prometheus.NewConstMetric(q.desc, prometheus.GaugeValue, value, labels...)
+	return q.newMetric(conn, labels, value, ts, created)
+}
+
+// named layouts of Query.TimeFormat
+var timeFormats = map[string]string{
+	"rfc3339": time.RFC3339,
+	"date":    "2006-01-02",
+}
+
+// formatTime formats the value of a time label column, see Query.TimeFormat.
+// Times are formatted in UTC as RFC 3339 by default.
+func (q *Query) formatTime(column string, t time.Time) string {
+	format := q.TimeFormat[column]
+	if format == "unix" {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	layout, found := timeFormats[format]
+	if !found {
+		layout = format
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return t.UTC().Format(layout)
+}
+
+// coercionError counts a column value which couldn't be converted
+func (q *Query) coercionError(column string, i interface{}) {
+	q.stats.valueCoercionErrors.WithLabelValues(q.job, q.Name, column, fmt.Sprintf("%T", i)).Inc()
+}
+
+// parseValue converts the value of a metric column to a float
+func parseValue(column string, i interface{}) (float64, error) {
+	switch f := i.(type) {
+	case int:
+		return float64(f), nil
+	case int32:
+		return float64(f), nil
+	case int64:
+		return float64(f), nil
+	case uint:
+		return float64(f), nil
+	case uint32:
+		return float64(f), nil
+	case uint64:
+		return float64(f), nil
+	case float32:
+		return float64(f), nil
+	case float64:
+		return float64(f), nil
+	case []uint8:
+		val, err := strconv.ParseFloat(string(f), 64)
+		if err != nil {
+			return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+		}
+		return val, nil
+	case string:
+		val, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+		}
+		return val, nil
+	default:
+		return 0, fmt.Errorf("Column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+	}
+}
+
+// timestampLayouts are tried in order to parse textual timestamps
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+}
+
+// timestamp returns the sample time from the timestamp column of a row, see
+// timeColumn
+func (q *Query) timestamp(res map[string]interface{}) (time.Time, error) {
+	return q.timeColumn(q.TimestampColumn, res)
+}
+
+// timeColumn returns the time of the given column of a row. It's either a
+// time or a unix timestamp in seconds. The zero time is returned if no column
+// is given or its value is NULL.
+func (q *Query) timeColumn(col string, res map[string]interface{}) (time.Time, error) {
+	if col == "" {
+		return time.Time{}, nil
+	}
+	i, ok := res[col]
+	if !ok {
+		return time.Time{}, fmt.Errorf("Timestamp column '%s' not found", col)
+	}
+	var raw string
+	switch t := i.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return t, nil
+	case []uint8:
+		raw = string(t)
+	case string:
+		raw = t
+	}
+	for _, layout := range timestampLayouts {
+		if raw == "" {
+			break
+		}
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t, nil
+		}
+	}
+	sec, err := parseValue(col, i)
+	if err != nil {
+		q.coercionError(col, i)
+		return time.Time{}, fmt.Errorf("Timestamp column '%s' must be a time or unix timestamp, is '%T'", col, i)
+	}
+	return time.Unix(0, int64(sec*float64(time.Second))), nil
+}
+
+// withTimestamp sets the sample timestamp of m, unless ts is the zero time
+func withTimestamp(m prometheus.Metric, ts time.Time) prometheus.Metric {
+	if ts.IsZero() {
+		return m
+	}
+	return prometheus.NewMetricWithTimestamp(ts, m)
 }
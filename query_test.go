@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func BenchmarkUpdateMetrics(b *testing.B) {
+	q := &Query{Name: "table_rows", Help: "Rows.", job: "bench", log: log.NewNopLogger(), stats: newExporterStats()}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_rows", "metric_size", "schema", "table"}
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+	res := map[string]interface{}{
+		"schema":      []uint8("public"),
+		"table":       "users",
+		"metric_rows": []uint8("12345"),
+		"metric_size": []uint8("8192"),
+	}
+	metrics := make([]prometheus.Metric, 0, 2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if metrics, err = q.updateMetrics(metrics[:0], conn, res, valueNames, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqlQueryer runs statements, it's implemented by *sql.DB, *sql.Conn and
+// *sql.Tx
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// txDrivers are the drivers on which transactions can be started with
+// statements, see beginStatements. The vendored drivers support neither
+// sql.TxOptions.ReadOnly nor the isolation levels.
+var txDrivers = map[string]bool{
+	"postgres":   true,
+	"postgresql": true,
+	"mysql":      true,
+}
+
+// isolationLevels are the SQL isolation levels by their config names
+var isolationLevels = map[string]string{
+	"read_uncommitted": "READ UNCOMMITTED",
+	"read_committed":   "READ COMMITTED",
+	"repeatable_read":  "REPEATABLE READ",
+	"serializable":     "SERIALIZABLE",
+}
+
+// txOptions are the options of a transaction started with statements
+type txOptions struct {
+	readOnly  bool
+	snapshot  bool   // one consistent snapshot for all queries
+	isolation string // see isolationLevels, the default of the database if empty
+}
+
+// beginStatements returns the statements which start a transaction with the
+// given options on driver
+func beginStatements(driver string, opts txOptions) ([]string, error) {
+	if !txDrivers[driver] {
+		return nil, fmt.Errorf("transaction options are not supported on %s", driver)
+	}
+	level := isolationLevels[opts.isolation]
+	if driver == "mysql" {
+		var stmts []string
+		if level != "" {
+			// applies to the next transaction of the session only
+			stmts = append(stmts, "SET TRANSACTION ISOLATION LEVEL "+level)
+		}
+		var chars []string
+		if opts.snapshot {
+			chars = append(chars, "WITH CONSISTENT SNAPSHOT")
+		}
+		if opts.readOnly {
+			chars = append(chars, "READ ONLY")
+		}
+		return append(stmts, strings.TrimSpace("START TRANSACTION "+strings.Join(chars, ", "))), nil
+	}
+	stmt := "BEGIN"
+	if level == "" && opts.snapshot {
+		// the default READ COMMITTED takes a snapshot per statement
+		level = isolationLevels["repeatable_read"]
+	}
+	if level != "" {
+		stmt += " ISOLATION LEVEL " + level
+	}
+	if opts.readOnly {
+		stmt += " READ ONLY"
+	}
+	return []string{stmt}, nil
+}
+
+// stmtTx is a transaction started with statements instead of sql.Tx, see
+// beginStatements, so it keeps a connection of the pool until it ends. With
+// setup statements it may also be a plain session on a driver without
+// transactions.
+type stmtTx struct {
+	conn    *sql.Conn
+	tx      bool // a transaction was started
+	discard bool // the setup changed the session, so the connection is closed
+}
+
+// beginStmtTx starts a transaction with the given options on a connection of
+// db and runs the setup statements in it, see Query.SetupQueries. Drivers
+// without transactions only run the setup, if the options are the defaults.
+func beginStmtTx(ctx context.Context, db *sql.DB, driver string, opts txOptions, setup []string) (*stmtTx, error) {
+	var stmts []string
+	if txDrivers[driver] || opts != (txOptions{}) {
+		var err error
+		if stmts, err = beginStatements(driver, opts); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t := &stmtTx{conn: conn, tx: len(stmts) > 0, discard: len(setup) > 0}
+	for _, stmt := range append(stmts, setup...) {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			t.end()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// end rolls the transaction back, which is as good as a commit since the
+// queries don't write, and returns the connection to the pool
+func (t *stmtTx) end() error {
+	var err error
+	if t.tx {
+		// the run may have timed out, the transaction has to end anyway
+		_, err = t.conn.ExecContext(context.Background(), "ROLLBACK")
+	}
+	if t.discard {
+		// e.g. a SET on MySQL outlives the transaction, the pool must not
+		// hand out the connection to other queries
+		t.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	t.conn.Close()
+	return err
+}
+
+// txRows are rows which end their transaction when closed
+type txRows struct {
+	resultRows
+	end func() error
+}
+
+// Close implements resultRows
+func (r *txRows) Close() error {
+	r.resultRows.Close()
+	return r.end()
+}
+
+// db returns where the statements of conn run, i.e. the snapshot of the
+// current run or the database handle
+func (c *connection) db() sqlQueryer {
+	if c.tx != nil {
+		return c.tx.conn
+	}
+	return c.conn.DB
+}
+
+// beginSnapshot starts the read-only transaction all queries of the run
+// share, see Job.Snapshot
+func (c *connection) beginSnapshot(ctx context.Context) error {
+	tx, err := beginStmtTx(ctx, c.conn.DB, c.driver, txOptions{readOnly: true, snapshot: true, isolation: c.isolation}, c.setup)
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	return nil
+}
+
+// endSnapshot ends the transaction of the run, if any
+func (c *connection) endSnapshot() error {
+	if c.tx == nil {
+		return nil
+	}
+	err := c.tx.end()
+	c.tx = nil
+	return err
+}
+
+// txOptions returns the options of the transaction of a query with the given
+// isolation level, which overrides the one of the connection
+func (c *connection) txOptions(isolation string) txOptions {
+	if isolation == "" {
+		isolation = c.isolation
+	}
+	return txOptions{readOnly: c.readOnly, isolation: isolation}
+}
+
+// query runs query on conn, in a transaction if it's read-only, has an
+// isolation level or setup statements, see Job.ReadOnly, Query.Isolation and
+// Query.SetupQueries
+func (c *connection) query(ctx context.Context, isolation string, setup []string, query string, args ...interface{}) (resultRows, error) {
+	if c.tx != nil {
+		// the setup of the connection ran when the snapshot began
+		rows, err := c.tx.conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlx.Rows{Rows: rows, Mapper: c.conn.Mapper}, nil
+	}
+	setup = c.setupStatements(setup)
+	opts := c.txOptions(isolation)
+	if !opts.readOnly && opts.isolation == "" && len(setup) == 0 {
+		return queryxContext(ctx, c.conn, query, args...)
+	}
+	tx, err := beginStmtTx(ctx, c.conn.DB, c.driver, opts, setup)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		tx.end()
+		return nil, err
+	}
+	return &txRows{resultRows: &sqlx.Rows{Rows: rows, Mapper: c.conn.Mapper}, end: tx.end}, nil
+}
+
+// setupStatements returns the setup statements of the connection followed by
+// the ones of a query
+func (c *connection) setupStatements(setup []string) []string {
+	if len(c.setup) == 0 {
+		return setup
+	}
+	return append(append([]string{}, c.setup...), setup...)
+}
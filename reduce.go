@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reduceAvg is the average, the other functions of Query.Reduce are the ones
+// of Query.Aggregation
+const reduceAvg = "avg"
+
+// validReduce reports whether fn is a supported function of Query.Reduce
+func validReduce(fn string) bool {
+	switch fn {
+	case aggregationSum, aggregationMax, aggregationMin, reduceAvg:
+		return true
+	}
+	return false
+}
+
+// reducer folds a column of all rows of a result into a single value
+type reducer struct {
+	fn    string
+	value float64 // the sum for avg
+	n     int
+}
+
+// add folds the value of a row into the result, NULL values are skipped
+func (r *reducer) add(column string, i interface{}) error {
+	if i == nil {
+		return nil
+	}
+	value, err := parseValue(column, i)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.n == 0:
+		r.value = value
+	case r.fn == aggregationSum || r.fn == reduceAvg:
+		r.value += value
+	case r.fn == aggregationMax && value > r.value:
+		r.value = value
+	case r.fn == aggregationMin && value < r.value:
+		r.value = value
+	}
+	r.n++
+	return nil
+}
+
+// result returns the reduced value, false if no row had a value
+func (r *reducer) result() (float64, bool) {
+	if r.n == 0 {
+		return 0, false
+	}
+	if r.fn == reduceAvg {
+		return r.value / float64(r.n), true
+	}
+	return r.value, true
+}
+
+// reduceMetricName returns the name of the reduced metric, e.g.
+// sql_latency_max
+func (q *Query) reduceMetricName() string {
+	return q.metricName() + "_" + q.Reduce.Func
+}
+
+// newReduceDesc returns the descriptor of the reduced metric, which only has
+// the labels of the connection. They are the same for the whole job, so it
+// never changes.
+func (q *Query) newReduceDesc(connLabels []string) *prometheus.Desc {
+	labelNames := append(append([]string{}, reservedLabels...), connLabels...)
+	return prometheus.NewDesc(
+		q.reduceMetricName(),
+		fmt.Sprintf("The %s of %s over all rows of %s.", q.Reduce.Func, q.Reduce.Column, q.metricName()),
+		labelNames,
+		q.descConstLabels(),
+	)
+}
+
+// reduceMetric returns the reduced metric of a run on conn, nil if no row had
+// a value
+func (q *Query) reduceMetric(conn *connection, r *reducer) (prometheus.Metric, error) {
+	value, ok := r.result()
+	if !ok {
+		return nil, nil
+	}
+	labels := append([]string{conn.driver, conn.host, conn.database, conn.user}, conn.labelValues...)
+	return prometheus.NewConstMetric(q.reduceDesc, prometheus.GaugeValue, value, labels...)
+}
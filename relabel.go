@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// actions of a RelabelRule
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelMap  = "labelmap"
+)
+
+// RelabelRule rewrites the labels of the metrics of a query before they are
+// cached, like the relabel_configs of Prometheus
+type RelabelRule struct {
+	SourceLabels []string `yaml:"source_labels"` // labels whose values are joined by separator and matched by regex
+	Separator    *string  `yaml:"separator"`     // defaults to ;
+	Regex        string   `yaml:"regex"`         // anchored, defaults to (.*)
+	TargetLabel  string   `yaml:"target_label"`  // label set by replace
+	Replacement  *string  `yaml:"replacement"`   // value of replace or label name of labelmap, $1 refers to the first group, defaults to $1
+	Action       string   `yaml:"action"`        // replace (default), keep, drop, labeldrop or labelmap
+	re           *regexp.Regexp
+}
+
+// compile validates the rule and compiles its regex
+func (r *RelabelRule) compile() error {
+	regex := r.Regex
+	if regex == "" {
+		regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex '%s': %s", r.Regex, err)
+	}
+	r.re = re
+	switch r.Action {
+	case "", relabelReplace:
+		if !LabelNameRE.MatchString(r.TargetLabel) {
+			return fmt.Errorf("relabel action replace needs a valid target_label, got '%s'", r.TargetLabel)
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action %s needs source_labels", r.Action)
+		}
+	case relabelLabelDrop, relabelLabelMap:
+	default:
+		return fmt.Errorf("unknown relabel action '%s'", r.Action)
+	}
+	return nil
+}
+
+func (r *RelabelRule) replacement() string {
+	if r.Replacement == nil {
+		return "$1"
+	}
+	return *r.Replacement
+}
+
+// relabel applies rules to the label names and values of a metric and
+// returns the new ones, or false if the metric is dropped. The names only
+// depend on the names, so the descriptor is set up once with values nil,
+// which keeps everything.
+func relabel(rules []RelabelRule, names, values []string) ([]string, []string, bool) {
+	if len(rules) == 0 {
+		return names, values, true
+	}
+	names = append([]string{}, names...)
+	if values != nil {
+		values = append([]string{}, values...)
+	}
+	for i := range rules {
+		r := &rules[i]
+		switch r.Action {
+		case relabelLabelDrop:
+			kept := 0
+			for j, name := range names {
+				if r.re.MatchString(name) {
+					continue
+				}
+				names[kept] = name
+				if values != nil {
+					values[kept] = values[j]
+				}
+				kept++
+			}
+			names = names[:kept]
+			if values != nil {
+				values = values[:kept]
+			}
+		case relabelLabelMap:
+			for j, n := 0, len(names); j < n; j++ {
+				m := r.re.FindStringSubmatchIndex(names[j])
+				if m == nil {
+					continue
+				}
+				target := string(r.re.ExpandString(nil, r.replacement(), names[j], m))
+				value := ""
+				if values != nil {
+					value = values[j]
+				}
+				names, values = setLabel(names, values, target, value)
+			}
+		default:
+			if values == nil {
+				if r.Action == "" || r.Action == relabelReplace {
+					names, _ = setLabel(names, nil, r.TargetLabel, "")
+				}
+				continue
+			}
+			source := make([]string, len(r.SourceLabels))
+			for j, name := range r.SourceLabels {
+				source[j] = labelValue(names, values, name)
+			}
+			separator := ";"
+			if r.Separator != nil {
+				separator = *r.Separator
+			}
+			joined := strings.Join(source, separator)
+			m := r.re.FindStringSubmatchIndex(joined)
+			switch r.Action {
+			case relabelKeep:
+				if m == nil {
+					return nil, nil, false
+				}
+			case relabelDrop:
+				if m != nil {
+					return nil, nil, false
+				}
+			default:
+				// the label is part of the descriptor even without a match
+				value := labelValue(names, values, r.TargetLabel)
+				if m != nil {
+					value = string(r.re.ExpandString(nil, r.replacement(), joined, m))
+				}
+				names, values = setLabel(names, values, r.TargetLabel, value)
+			}
+		}
+	}
+	return names, values, true
+}
+
+// labelValue returns the value of the label name, or an empty string
+func labelValue(names, values []string, name string) string {
+	for i, n := range names {
+		if n == name {
+			return values[i]
+		}
+	}
+	return ""
+}
+
+// setLabel sets the label name to value, appending it if it's new. values
+// may be nil if only the names matter.
+func setLabel(names, values []string, name, value string) ([]string, []string) {
+	for i, n := range names {
+		if n == name {
+			if values != nil {
+				values[i] = value
+			}
+			return names, values
+		}
+	}
+	names = append(names, name)
+	if values != nil {
+		values = append(values, value)
+	}
+	return names, values
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cumulativeSeries is the state of a series of a cumulative query
+type cumulativeSeries struct {
+	last   float64 // last value returned by the database
+	offset float64 // sum of the values before each reset
+	seen   bool    // seen in the current run
+
+	created   time.Time // creation time of the exported counter
+	dbCreated time.Time // last creation time from the database, see Query.CreatedColumn
+}
+
+// handling of negative values of cumulative counters, see
+// Query.NegativeCounters. Negative values are kept by default.
+const (
+	negativeKeep   = "keep"
+	negativeClamp  = "clamp"  // export 0 instead
+	negativeReject = "reject" // skip the value
+)
+
+// validNegativeCounters reports whether the negative_counters option is known
+func validNegativeCounters(handling string) bool {
+	switch handling {
+	case "", negativeKeep, negativeClamp, negativeReject:
+		return true
+	}
+	return false
+}
+
+// newMetric returns the const metric of a series. The values of cumulative
+// queries are exported as counters, see cumulate, and the ones of untyped
+// queries as untyped. created is the creation time of the counter in the
+// database, if known, see CreatedColumn. The metric is nil if the
+// relabel_configs drop it.
+func (q *Query) newMetric(conn *connection, labels []string, value float64, ts, created time.Time) (prometheus.Metric, error) {
+	_, relabeled, keep := relabel(q.RelabelConfigs, q.descLabels, labels)
+	if !keep {
+		return nil, nil
+	}
+	valueType := prometheus.GaugeValue
+	if q.Untyped {
+		valueType = prometheus.UntypedValue
+	}
+	if q.Cumulative {
+		valueType = prometheus.CounterValue
+		value, created = q.cumulate(conn, labels, value, created)
+	}
+	if q.Delta {
+		q.recordDelta(conn, labels, value)
+	}
+	var m prometheus.Metric
+	var err error
+	if q.Cumulative {
+		// the created time is exported as the _created sample of OpenMetrics
+		m, err = prometheus.NewConstMetricWithCreatedTimestamp(q.getDesc(), valueType, value, created, relabeled...)
+	} else {
+		m, err = prometheus.NewConstMetric(q.getDesc(), valueType, value, relabeled...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withTimestamp(m, ts), nil
+}
+
+// cumulate turns the value of a counter in the database into a value which
+// never decreases. A decrease is a reset of the counter, e.g. after a restart
+// of the database, so the value before the reset is carried over. So is a
+// change of the creation time of the counter, if known. The counter is
+// created when the series is seen first or at the creation time of the
+// first run and never afterwards, since it never resets. It returns the
+// value and the creation time of the exported counter.
+func (q *Query) cumulate(conn *connection, labels []string, value float64, created time.Time) (float64, time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	key := q.seriesKey(labels)
+	if q.cumulative == nil {
+		q.cumulative = make(map[*connection]map[string]*cumulativeSeries)
+	}
+	if q.cumulative[conn] == nil {
+		q.cumulative[conn] = make(map[string]*cumulativeSeries)
+	}
+	s, found := q.cumulative[conn][key]
+	if !found {
+		s = &cumulativeSeries{created: created, dbCreated: created}
+		if created.IsZero() {
+			s.created = time.Now()
+		}
+		q.cumulative[conn][key] = s
+	} else if value < s.last || !created.IsZero() && !s.dbCreated.IsZero() && !created.Equal(s.dbCreated) {
+		s.offset += s.last
+	}
+	s.last = value
+	s.dbCreated = created
+	s.seen = true
+	return s.offset + value, s.created
+}
+
+// resetCumulative starts a new run of the query on conn
+func (q *Query) resetCumulative(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	for _, s := range q.cumulative[conn] {
+		s.seen = false
+	}
+}
+
+// pruneCumulative drops the series which were not returned by the last run,
+// they start over if they come back
+func (q *Query) pruneCumulative(conn *connection) {
+	q.Lock()
+	defer q.Unlock()
+	for key, s := range q.cumulative[conn] {
+		if !s.seen {
+			delete(q.cumulative[conn], key)
+		}
+	}
+}
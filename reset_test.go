@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCumulateReset(t *testing.T) {
+	q := &Query{Name: "rows", Help: "Rows.", Cumulative: true, job: "test", log: log.NewNopLogger(), stats: newExporterStats()}
+	conn := &connection{driver: "postgres", host: "db", database: "shop", user: "exporter"}
+	valueNames := []string{"metric_value", "state"}
+	q.setDesc(q.labelNames(conn.labelNames, valueNames))
+
+	// the value changes and resets, the series stays the same
+	var series string
+	for i, tc := range []struct {
+		value float64
+		want  float64
+	}{
+		{100, 100},
+		{50, 150},
+		{70, 170},
+	} {
+		res := map[string]interface{}{
+			"metric_value": strconv.FormatFloat(tc.value, 'f', -1, 64),
+			"state":        "ok",
+		}
+		metrics, err := q.updateMetrics(nil, conn, res, valueNames, nil)
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if len(metrics) != 1 {
+			t.Fatalf("run %d: %d metrics, want 1", i, len(metrics))
+		}
+		var pb dto.Metric
+		if err := metrics[0].Write(&pb); err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if got := pb.GetCounter().GetValue(); got != tc.want {
+			t.Errorf("run %d: value %v, want %v", i, got, tc.want)
+		}
+		s := labelPairs(&pb)
+		if strings.Contains(s, "metric_value=") {
+			t.Errorf("run %d: series %s has the value label", i, s)
+		}
+		if series == "" {
+			series = s
+		} else if s != series {
+			t.Errorf("run %d: series %s, want %s", i, s, series)
+		}
+	}
+	if n := len(q.cumulative[conn]); n != 1 {
+		t.Errorf("%d series, want 1", n)
+	}
+}
+
+// labelPairs returns the labels of a metric as name=value pairs
+func labelPairs(pb *dto.Metric) string {
+	var s string
+	for _, lp := range pb.GetLabel() {
+		s += lp.GetName() + "=" + lp.GetValue() + ","
+	}
+	return s
+}
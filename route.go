@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// supported values for Connection.Route
+const (
+	routePrimary       = "primary"
+	routeStandby       = "standby"
+	routePreferStandby = "prefer_standby"
+)
+
+// standbySQL asks a database whether it is a read-only standby by driver.
+// The vendored drivers can't route on their own, so the exporter asks each of
+// the hosts of a connection.
+var standbySQL = map[string]string{
+	"postgres":   "SELECT pg_is_in_recovery()",
+	"postgresql": "SELECT pg_is_in_recovery()",
+	"mysql":      "SELECT @@global.read_only",
+}
+
+// validRoute reports whether route is supported for driver
+func validRoute(route, driver string) bool {
+	switch route {
+	case routePrimary, routeStandby, routePreferStandby:
+		_, found := standbySQL[driver]
+		return found
+	}
+	return false
+}
+
+// routedURL returns the URL of the first host of the connection with the role
+// asked for by its route, or the first primary if it prefers a standby and
+// none is reachable. Unreachable hosts are skipped.
+func (c *connection) routedURL(job *Job) (*url.URL, string, error) {
+	var primary *url.URL
+	var primaryHost string
+	var errs []string
+	for _, host := range c.routeHosts {
+		u := c.hostURL(host)
+		standby, err := isStandby(u, c.timeout)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", host, err))
+			continue
+		}
+		switch {
+		case standby && c.route != routePrimary:
+			return u, host, nil
+		case !standby && c.route == routePrimary:
+			return u, host, nil
+		case !standby && c.route == routePreferStandby && primary == nil:
+			primary, primaryHost = u, host
+		}
+	}
+	if primary != nil {
+		level.Warn(job.log).Log("msg", "No standby reachable, using the primary", "host", primaryHost, "db", c.database)
+		return primary, primaryHost, nil
+	}
+	if len(errs) > 0 {
+		return nil, "", fmt.Errorf("no %s host found: %s", c.route, strings.Join(errs, "; "))
+	}
+	return nil, "", fmt.Errorf("no %s host found", c.route)
+}
+
+// hostURL returns a copy of the URL of the connection which points to host,
+// see driverDSN for the DSN the driver gets
+func (c *connection) hostURL(host string) *url.URL {
+	u := *c.url
+	u.Host = host
+	return &u
+}
+
+// isStandby connects to the database of u within timeout and asks for its
+// role
+func isStandby(u *url.URL, timeout time.Duration) (bool, error) {
+	db, err := connectTimeout(u.Scheme, driverDSN(u), timeout)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var standby bool
+	err = db.QueryRowContext(ctx, standbySQL[u.Scheme]).Scan(&standby)
+	return standby, err
+}
@@ -0,0 +1,45 @@
+package main
+
+// rowScanner scans the rows of a result set into a map, like sqlx.MapScan.
+// It's set up once for the columns of the result set and reuses the scan
+// destinations and the map for every row, instead of allocating them per row.
+// The map is only valid until the next call to scan.
+type rowScanner struct {
+	cols   []string
+	values []interface{}
+	dest   []interface{}
+	res    map[string]interface{}
+}
+
+// newRowScanner returns a scanner for a result set with the given columns
+func newRowScanner(cols []string) *rowScanner {
+	s := &rowScanner{
+		cols:   cols,
+		values: make([]interface{}, len(cols)),
+		dest:   make([]interface{}, len(cols)),
+		res:    make(map[string]interface{}, len(cols)),
+	}
+	for i := range s.values {
+		s.dest[i] = &s.values[i]
+	}
+	return s
+}
+
+// scan scans the current row. Byte slices are copied by database/sql when
+// scanning into an interface{}, so values don't change with the next row.
+func (s *rowScanner) scan(rows resultRows) (map[string]interface{}, error) {
+	for i := range s.values {
+		s.values[i] = nil
+	}
+	if err := rows.Scan(s.dest...); err != nil {
+		return nil, err
+	}
+	for i, col := range s.cols {
+		// a column dropped by Query.positionColumns
+		if col == "" {
+			continue
+		}
+		s.res[col] = s.values[i]
+	}
+	return s.res, nil
+}
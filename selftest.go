@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// selfTestResult is the result of the self-test of a query on a connection
+type selfTestResult struct {
+	Job        string   `json:"job"`
+	Query      string   `json:"query"`
+	Host       string   `json:"host"`
+	Database   string   `json:"database"`
+	OK         bool     `json:"ok"`
+	Error      string   `json:"error,omitempty"`
+	Missing    []string `json:"missing_columns,omitempty"`    // expected columns the query didn't return
+	Unexpected []string `json:"unexpected_columns,omitempty"` // returned columns which were not expected
+	TypeErrors []string `json:"type_errors,omitempty"`        // columns of the first row with a wrong type
+}
+
+// SelfTest runs every query with expected columns once on each of its
+// connections and compares the returned columns with the expected ones. The
+// queries run on separate database handles, so the running jobs are not
+// affected.
+func (e *Exporter) SelfTest(ctx context.Context) []selfTestResult {
+	e.RLock()
+	jobs := e.jobs
+	e.RUnlock()
+
+	results := make([]selfTestResult, 0)
+	for _, job := range jobs {
+		for _, q := range job.Queries {
+			if q == nil || len(q.ExpectedColumns) == 0 {
+				continue
+			}
+			for _, conn := range job.connections() {
+				if !q.selects(conn) {
+					continue
+				}
+				results = append(results, job.selfTest(ctx, q, conn))
+			}
+		}
+	}
+	return results
+}
+
+// selfTest runs q on a new database handle for conn
+func (j *Job) selfTest(ctx context.Context, q *Query, conn *connection) selfTestResult {
+	res := selfTestResult{
+		Job:      j.Name,
+		Query:    q.Name,
+		Host:     conn.host,
+		Database: conn.database,
+	}
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	u := conn.url
+	if conn.proxy != nil {
+		target, err := proxyTarget(conn.url)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		f, err := newForwarder(j.log, conn.proxy, target)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		defer f.close()
+		u = proxiedURL(conn.url, f.addr())
+	}
+	db, err := connectTimeout(conn.driver, driverDSN(u), conn.timeout)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer db.Close()
+	test := &connection{conn: db, driver: conn.driver, host: conn.host, database: conn.database, readOnly: conn.readOnly, isolation: conn.isolation, setup: conn.setup}
+
+	rows, err := q.query(ctx, test)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Missing, res.Unexpected = diffColumns(q.ExpectedColumns, cols)
+	if cols, err = q.positionColumns(cols); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if cols, err = q.checkDuplicates(test, cols); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	// the types are checked on the first row only, like on startup
+	if rows.Next() {
+		row, err := newRowScanner(cols).scan(rows)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if err := q.extractJSON(row); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		valueNames := q.filterColumns(cols)
+		if q.Format == formatSingle {
+			single, err := q.singleColumn(cols)
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			valueNames = []string{single}
+		}
+		for _, e := range q.typeErrors(row, valueNames) {
+			res.TypeErrors = append(res.TypeErrors, fmt.Sprintf("%s: %s (%s)", e.column, e.reason, e.typ))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.OK = len(res.Missing) == 0 && len(res.Unexpected) == 0 && len(res.TypeErrors) == 0
+	return res
+}
+
+// diffColumns returns the sorted expected columns which are missing from cols
+// and the columns which were not expected
+func diffColumns(expected, cols []string) (missing, unexpected []string) {
+	want := make(map[string]bool, len(expected))
+	for _, col := range expected {
+		want[col] = true
+	}
+	got := make(map[string]bool, len(cols))
+	for _, col := range cols {
+		got[col] = true
+		if !want[col] {
+			unexpected = append(unexpected, col)
+		}
+	}
+	for _, col := range expected {
+		if !got[col] {
+			missing = append(missing, col)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	return missing, unexpected
+}
+
+// selfTestHandler serves the results of Exporter.SelfTest as JSON. The status
+// is 500 if any query failed.
+func selfTestHandler(e *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := e.SelfTest(r.Context())
+		status := http.StatusOK
+		for _, res := range results {
+			if !res.OK {
+				status = http.StatusInternalServerError
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			level.Error(e.logger).Log("msg", "Failed to write self-test results", "err", err)
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// querySlots bounds the number of queries running at once across all jobs, see
+// File.GlobalMaxConnections. A nil querySlots doesn't limit anything.
+type querySlots struct {
+	slots   chan struct{}
+	waiting prometheus.Gauge // queries waiting in acquire
+}
+
+// newQuerySlots returns the slots for at most n queries at once, or nil if n
+// is 0
+func newQuerySlots(n int, waiting prometheus.Gauge) *querySlots {
+	if n <= 0 {
+		return nil
+	}
+	return &querySlots{slots: make(chan struct{}, n), waiting: waiting}
+}
+
+// acquire waits for a free slot until ctx is done
+func (s *querySlots) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.waiting.Inc()
+	defer s.waiting.Dec()
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot taken by acquire
+func (s *querySlots) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+)
+
+// source is a backend which isn't SQL, e.g. Redis or an HTTP endpoint, but
+// returns rows like a query, so the columns become labels and values just
+// the same. Sources are registered as database/sql drivers by the scheme of
+// their connection URLs, see registerSource, so they share the connection
+// handling and metrics of the SQL drivers.
+type source interface {
+	// open connects to the backend of a connection URL
+	open(dsn string) (sourceConn, error)
+}
+
+// sourceConn is a connection to the backend of a source
+type sourceConn interface {
+	// query runs query, whose syntax depends on the source, and returns the
+	// columns and rows of the result
+	query(ctx context.Context, query string) (cols []string, rows [][]driver.Value, err error)
+	io.Closer
+}
+
+// sources are the names of the registered sources
+var sources = make(map[string]bool)
+
+// registerSource registers s as the database/sql driver name
+func registerSource(name string, s source) {
+	sources[name] = true
+	sql.Register(name, sourceDriver{s})
+}
+
+// isSource reports whether the driver name is a source, which runs no SQL
+func isSource(name string) bool {
+	return sources[name]
+}
+
+// sourceDriver adapts a source to database/sql. Queries can't have
+// parameters and transactions aren't supported.
+type sourceDriver struct {
+	source source
+}
+
+// Open implements driver.Driver
+func (d sourceDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.source.open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceDriverConn{conn: conn}, nil
+}
+
+type sourceDriverConn struct {
+	conn   sourceConn
+	broken bool // a query failed with an error other than rejectedError
+}
+
+// rejectedError is an error of the backend about the query, the connection
+// can still be used. All other errors close the connection.
+type rejectedError struct {
+	msg string
+}
+
+func (e rejectedError) Error() string { return e.msg }
+
+// IsValid implements driver.Validator
+func (c *sourceDriverConn) IsValid() bool {
+	return !c.broken
+}
+
+// Prepare implements driver.Conn
+func (c *sourceDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return &sourceStmt{c, query}, nil
+}
+
+// Close implements driver.Conn
+func (c *sourceDriverConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin implements driver.Conn
+func (c *sourceDriverConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+// QueryContext implements driver.QueryerContext
+func (c *sourceDriverConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("parameters are not supported")
+	}
+	cols, rows, err := c.conn.query(ctx, query)
+	if err != nil {
+		// the connection may be in any state after a failure
+		if _, ok := err.(rejectedError); !ok {
+			c.broken = true
+		}
+		return nil, err
+	}
+	return &sourceRows{cols: cols, rows: rows}, nil
+}
+
+// sourceStmt runs a query without a context, e.g. the startup SQL
+type sourceStmt struct {
+	conn  *sourceDriverConn
+	query string
+}
+
+// Close implements driver.Stmt
+func (s *sourceStmt) Close() error { return nil }
+
+// NumInput implements driver.Stmt
+func (s *sourceStmt) NumInput() int { return 0 }
+
+// Exec implements driver.Stmt
+func (s *sourceStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.conn.QueryContext(context.Background(), s.query, nil); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// Query implements driver.Stmt
+func (s *sourceStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, nil)
+}
+
+// sourceRows are the rows of a source query, which are read at once
+type sourceRows struct {
+	cols []string
+	rows [][]driver.Value
+	next int
+}
+
+// Columns implements driver.Rows
+func (r *sourceRows) Columns() []string { return r.cols }
+
+// Close implements driver.Rows
+func (r *sourceRows) Close() error { return nil }
+
+// Next implements driver.Rows
+func (r *sourceRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
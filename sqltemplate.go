@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// loopParamPrefix is the prefix of the generated names of the parameters
+// bound by the param function of a query template
+const loopParamPrefix = "sql_exporter_loop_"
+
+// identRE matches the identifiers which can be interpolated into a query,
+// optionally qualified, e.g. public.users
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// ident returns s if it is a plain identifier and fails otherwise, so nothing
+// but a name can end up in an identifier position of a query
+func ident(s string) (string, error) {
+	if !identRE.MatchString(s) {
+		return "", fmt.Errorf("invalid identifier %q", s)
+	}
+	return s, nil
+}
+
+// parseQueryTemplate parses a query template. Its actions may only print the
+// result of ident, for identifiers, or param, for all other values. param
+// binds the value as a named parameter through bindParams, so data never
+// becomes part of the query.
+func parseQueryTemplate(name, query string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"ident": ident,
+		// replaced on execution, see executeQueryTemplate
+		"param": func(string) string { return "" },
+	}).Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplate(tmpl.Tree.Root); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executeQueryTemplate executes the template with the item and returns the
+// query and the values to bind by parameter name
+func executeQueryTemplate(tmpl *template.Template, item string) (string, map[string]string, error) {
+	params := make(map[string]string)
+	t, err := tmpl.Clone()
+	if err != nil {
+		return "", nil, err
+	}
+	t.Funcs(template.FuncMap{
+		"param": func(value string) string {
+			name := loopParamPrefix + strconv.Itoa(len(params)+1)
+			params[name] = value
+			return ":" + name
+		},
+	})
+	var b strings.Builder
+	if err := t.Execute(&b, item); err != nil {
+		return "", nil, err
+	}
+	return b.String(), params, nil
+}
+
+// checkTemplate fails for every action which prints something else than the
+// result of ident or param
+func checkTemplate(node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := checkTemplate(c); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		// declarations like {{$t := .}} don't print anything
+		if len(n.Pipe.Decl) > 0 {
+			return nil
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if f, ok := last.Args[0].(*parse.IdentifierNode); ok && (f.Ident == "ident" || f.Ident == "param") {
+			return nil
+		}
+		return fmt.Errorf("%s must use ident or param", n)
+	case *parse.IfNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return checkBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		return fmt.Errorf("%s is not allowed in queries", n)
+	}
+	return nil
+}
+
+func checkBranch(n *parse.BranchNode) error {
+	if err := checkTemplate(n.List); err != nil {
+		return err
+	}
+	return checkTemplate(n.ElseList)
+}
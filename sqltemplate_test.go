@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT * FROM {{.}}", false},
+		{`SELECT * FROM {{printf "%s" .}}`, false},
+		{`SELECT * FROM {{ident . | printf "%s"}}`, false},
+		{`SELECT * FROM {{template "x"}}`, false},
+		{`SELECT * FROM {{if .}}{{.}}{{end}}`, false},
+		{"SELECT * FROM {{ident .}}", true},
+		{"SELECT * FROM {{. | ident}}", true},
+		{"SELECT * FROM t WHERE name = {{param .}}", true},
+		{"{{$t := .}}SELECT * FROM {{ident $t}}", true},
+	} {
+		_, err := parseQueryTemplate("test", tc.query)
+		if tc.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.query, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected an error", tc.query)
+		}
+	}
+}
+
+func TestIdent(t *testing.T) {
+	for _, tc := range []struct {
+		s  string
+		ok bool
+	}{
+		{"users", true},
+		{"public.users", true},
+		{"_tmp1", true},
+		{"x; DROP TABLE users", false},
+		{"users--", false},
+		{`"users"`, false},
+		{"1users", false},
+		{"public.", false},
+		{"", false},
+	} {
+		got, err := ident(tc.s)
+		if tc.ok && (err != nil || got != tc.s) {
+			t.Errorf("ident(%q) = %q, %v, want %q", tc.s, got, err, tc.s)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("ident(%q) = %q, expected an error", tc.s, got)
+		}
+	}
+}
+
+func TestExecuteQueryTemplate(t *testing.T) {
+	tmpl, err := parseQueryTemplate("test", "SELECT * FROM {{ident .}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := executeQueryTemplate(tmpl, "users; DROP TABLE users"); err == nil {
+		t.Error("expected ident to reject the item")
+	}
+}
+
+func TestParamBinding(t *testing.T) {
+	const item = "o'brien'; DROP TABLE users; --"
+	tmpl, err := parseQueryTemplate("test", "SELECT * FROM t WHERE name = {{param .}} AND id::text <> ':x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, params, err := executeQueryTemplate(tmpl, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		driver string
+		query  string
+	}{
+		{"postgres", "SELECT * FROM t WHERE name = $1 AND id::text <> ':x'"},
+		{"sqlserver", "SELECT * FROM t WHERE name = @p1 AND id::text <> ':x'"},
+		{"mysql", "SELECT * FROM t WHERE name = ? AND id::text <> ':x'"},
+	} {
+		got, args := bindParams(tc.driver, query, params)
+		if got != tc.query {
+			t.Errorf("%s: query %q, want %q", tc.driver, got, tc.query)
+		}
+		if want := []interface{}{item}; !reflect.DeepEqual(args, want) {
+			t.Errorf("%s: args %q, want %q", tc.driver, args, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// checkStatements fails if any statement of query doesn't start with one of
+// the allowed keywords, e.g. SELECT. Comments, string literals and quoted
+// identifiers are skipped, so neither a leading comment nor a second
+// statement after a semicolon gets past the check. The SQL dialects and their
+// settings differ on what is a comment or a literal, so the query has to pass
+// the check in every reading of dialects. A statement explaining another one,
+// e.g. EXPLAIN ANALYZE which runs it, passes only if the explained statement
+// is allowed as well.
+func checkStatements(query string, allowed []string) error {
+	for _, d := range dialects {
+		for _, stmt := range splitStatements(query, d) {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			keyword := strings.ToUpper(firstWord(stmt))
+			if keyword == "" {
+				return fmt.Errorf("statement without keyword: %s", strings.TrimSpace(stmt))
+			}
+			if !allowedKeyword(keyword, allowed) {
+				return fmt.Errorf("statement %s is not allowed, allowed are %s", keyword, strings.Join(allowed, ", "))
+			}
+			if explained := explainedKeyword(stmt, keyword); explained != "" && !allowedKeyword(explained, allowed) {
+				return fmt.Errorf("statement %s %s is not allowed, allowed are %s", keyword, explained, strings.Join(allowed, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// allowedKeyword reports whether keyword is one of allowed, ignoring case
+func allowedKeyword(keyword string, allowed []string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(a, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialect is a reading of the parts of a query on which the SQL dialects or
+// their settings differ, see splitStatements
+type dialect struct {
+	escapes      string // quotes in which a backslash escapes the next character, e.g. ' and " on MySQL
+	prefixed     bool   // a backslash escapes in E'' strings, like on PostgreSQL
+	dollarQuotes bool   // $$text$$ strings of PostgreSQL
+	nested       bool   // nested /* */ comments of PostgreSQL and SQL Server
+	hashComments bool   // # comments of MySQL and ClickHouse
+	spacedDashes bool   // -- starts a comment only before a blank, like on MySQL
+	runComments  bool   // /*! */ comments of MySQL, whose contents run
+	brackets     bool   // [identifiers] of SQL Server
+}
+
+// dialects are all combinations of the readings of dialect. Mixing them
+// rejects more queries than a single database would, but a query which is
+// harmless on its database passes them all unless it relies on a difference
+// between the dialects around a semicolon.
+var dialects = func() []dialect {
+	var ds []dialect
+	for _, escapes := range []string{"", "E", "'", `'"`, "'\"`"} {
+		for bits := 0; bits < 1<<6; bits++ {
+			ds = append(ds, dialect{
+				escapes:      strings.TrimPrefix(escapes, "E"),
+				prefixed:     escapes == "E",
+				dollarQuotes: bits&1 != 0,
+				nested:       bits&2 != 0,
+				hashComments: bits&4 != 0,
+				spacedDashes: bits&8 != 0,
+				runComments:  bits&16 != 0,
+				brackets:     bits&32 != 0,
+			})
+		}
+	}
+	return ds
+}()
+
+// splitStatements returns the statements of query in the reading of d,
+// without comments. String literals and quoted identifiers are replaced by a
+// blank, so their contents can't be mistaken for keywords or semicolons. An
+// unterminated comment or literal ends the query.
+func splitStatements(query string, d dialect) []string {
+	var stmts []string
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '-' && i+1 < len(query) && query[i+1] == '-' &&
+			(!d.spacedDashes || i+2 == len(query) || query[i+2] <= ' '),
+			c == '#' && d.hashComments:
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			b.WriteByte(' ')
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			if d.runComments && i+2 < len(query) && query[i+2] == '!' {
+				// the contents are part of the statement, after an
+				// optional version
+				for i += 3; i < len(query) && query[i] >= '0' && query[i] <= '9'; i++ {
+				}
+				i--
+				b.WriteByte(' ')
+				continue
+			}
+			depth := 0
+			for ; i < len(query); i++ {
+				if query[i] == '*' && i+1 < len(query) && query[i+1] == '/' {
+					i++
+					if depth--; depth == 0 {
+						break
+					}
+				} else if query[i] == '/' && i+1 < len(query) && query[i+1] == '*' && (depth == 0 || d.nested) {
+					i++
+					depth++
+				}
+			}
+			b.WriteByte(' ')
+		case c == '*' && d.runComments && i+1 < len(query) && query[i+1] == '/':
+			// the end of a /*! comment
+			i++
+			b.WriteByte(' ')
+		case c == '\'' || c == '"' || c == '`' || c == '[' && d.brackets:
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			escapes := strings.IndexByte(d.escapes, c) >= 0 ||
+				d.prefixed && c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e') && (i == 1 || !isIdentChar(query[i-2]))
+			// a doubled quote is part of the literal
+			for i++; i < len(query); i++ {
+				if escapes && query[i] == '\\' {
+					i++
+					continue
+				}
+				if query[i] == end {
+					if i+1 < len(query) && query[i+1] == end {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b.WriteByte(' ')
+		case d.dollarQuotes && c == '$' && (i == 0 || !isIdentChar(query[i-1])):
+			tag := dollarTagRE.FindString(query[i:])
+			if tag == "" {
+				b.WriteByte(c)
+				continue
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+			b.WriteByte(' ')
+		case c == ';':
+			stmts = append(stmts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(stmts, b.String())
+}
+
+// explainable are the keywords of the statements which EXPLAIN may run, e.g.
+// with ANALYZE on PostgreSQL
+var explainable = map[string]bool{
+	"SELECT": true, "WITH": true, "INSERT": true, "UPDATE": true, "DELETE": true,
+	"MERGE": true, "REPLACE": true, "EXECUTE": true, "DECLARE": true, "CREATE": true,
+}
+
+// explainedKeyword returns the keyword of the statement explained by stmt,
+// which starts with keyword, or "" if stmt explains none, e.g. DESCRIBE of a
+// table. It's the first explainable word outside of parentheses, so options
+// like ANALYZE or format=json don't need to be known.
+func explainedKeyword(stmt, keyword string) string {
+	if keyword != "EXPLAIN" && keyword != "DESCRIBE" && keyword != "DESC" {
+		return ""
+	}
+	depth := 0
+	for i := strings.Index(strings.ToUpper(stmt), keyword) + len(keyword); i < len(stmt); i++ {
+		switch c := stmt[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == '_' || isAlnum(c)):
+			end := i
+			for end < len(stmt) && (stmt[end] == '_' || isAlnum(stmt[end])) {
+				end++
+			}
+			if word := strings.ToUpper(stmt[i:end]); explainable[word] {
+				return word
+			}
+			i = end - 1
+		}
+	}
+	return ""
+}
+
+// dollarTagRE matches the tag opening a dollar quoted string
+var dollarTagRE = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// isIdentChar reports whether c may be part of an unquoted identifier
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isAlnum(c)
+}
+
+// firstWord returns the first word of s, e.g. the keyword of a statement
+func firstWord(s string) string {
+	s = strings.TrimLeftFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '('
+	})
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if end < 0 {
+		return s
+	}
+	return s[:end]
+}
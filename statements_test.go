@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCheckStatements(t *testing.T) {
+	allowed := []string{"SELECT", "SHOW", "EXPLAIN", "DESCRIBE"}
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT 1", true},
+		{"-- leading comment\nSELECT ';' AS x; SHOW x", true},
+		{"SELECT 'it''s; fine', $$a$$, \"b\"", true},
+		{"SELECT 'C:\\' AS path", true},
+		{"EXPLAIN ANALYZE SELECT 1", true},
+		{"EXPLAIN FORMAT=JSON SELECT 1", true},
+		{"DESCRIBE orders", true},
+		{"DELETE FROM t", false},
+		{"/* SELECT */ DELETE FROM t", false},
+		{"SELECT 1; DELETE FROM t", false},
+		// backslash escapes of PostgreSQL E'' strings and MySQL strings
+		{"SELECT E'\\''; DELETE FROM t; --'", false},
+		{"SELECT '\\''; DELETE FROM t; -- '", false},
+		{"SELECT \"\\\"\"; DELETE FROM t; -- \"", false},
+		// EXPLAIN ANALYZE runs the statement
+		{"EXPLAIN ANALYZE DELETE FROM t", false},
+		{"EXPLAIN (ANALYZE, FORMAT JSON) DELETE FROM t", false},
+		// MySQL comments
+		{"SELECT 1 # '\n; DELETE FROM t; -- '", false},
+		{"SELECT 1 --1; DELETE FROM t", false},
+		{"SELECT 1 /*! ; DELETE FROM t */", false},
+		// nested comments of PostgreSQL
+		{"SELECT 1 /* /* */ ' */; DELETE FROM t; -- '", false},
+		// bracketed identifiers of SQL Server
+		{"SELECT [a']; DELETE FROM t; -- '", false},
+	} {
+		err := checkStatements(tc.query, allowed)
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.query, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%q: not rejected", tc.query)
+		}
+	}
+}